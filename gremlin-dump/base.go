@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+// baseDump is a previous dump used to make an incremental dump.
+// Resources that were not modified since the base dump
+// are taken from it instead of being read again.
+type baseDump struct {
+	lines  map[uuid.UUID][]byte
+	labels map[uuid.UUID]string
+	// lastModified is the id_perms.last_modified
+	// of each base dump resource
+	lastModified map[uuid.UUID]time.Time
+	current      map[uuid.UUID]bool
+	reread       map[uuid.UUID]bool
+	reused       map[uuid.UUID]bool
+	sync.Mutex
+}
+
+// loadBase reads a previous dump. Placeholders of missing resources
+// are skipped, they are rebuilt when the new dump is written.
+func loadBase(input io.Reader) (*baseDump, error) {
+	b := &baseDump{
+		lines:        make(map[uuid.UUID][]byte),
+		labels:       make(map[uuid.UUID]string),
+		lastModified: make(map[uuid.UUID]time.Time),
+		current:      make(map[uuid.UUID]bool),
+		reread:       make(map[uuid.UUID]bool),
+		reused:       make(map[uuid.UUID]bool),
+	}
+	r := bufio.NewReader(input)
+	for {
+		line, err := r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			vertex, err := g.ReadGsonVertex(line)
+			if err != nil {
+				return nil, err
+			}
+			b.labels[vertex.ID] = vertex.Label
+			if !vertex.HasProp("_missing") {
+				b.lines[vertex.ID] = line
+				if value, ok := vertex.PropertyValue("id_perms.last_modified"); ok {
+					if s, ok := value.(string); ok {
+						if t, err := utils.ParseContrailTime(s); err == nil {
+							b.lastModified[vertex.ID] = t
+						}
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reuse returns true when the resource is in the base dump and was
+// not modified since its version of the base dump. The base dump is
+// not a snapshot, so each resource is compared with its own version.
+// The full id_perms.last_modified is compared since the updated
+// property is truncated to the second. Resources of the base dump
+// without id_perms.last_modified are read again.
+func (b *baseDump) reuse(session gockle.Session, id uuid.UUID) bool {
+	b.Lock()
+	if b.current[id] {
+		// the resource is listed several times
+		defer b.Unlock()
+		return b.reused[id]
+	}
+	b.current[id] = true
+	base, ok := b.lastModified[id]
+	b.Unlock()
+
+	if ok {
+		lastModified, err := utils.GetContrailLastModifiedTime(session, id)
+		if err == nil && !lastModified.After(base) {
+			b.Lock()
+			b.reused[id] = true
+			b.Unlock()
+			return true
+		}
+	}
+
+	b.Lock()
+	b.reread[id] = true
+	b.Unlock()
+	return false
+}
+
+// reusedVertices returns the vertices taken from the base dump. Edges
+// with resources that were read again are removed since these
+// resources carry their own edges. Edges owned by removed resources
+// (backrefs, children) are removed as well.
+func (b *baseDump) reusedVertices() ([]g.Vertex, error) {
+	b.Lock()
+	defer b.Unlock()
+	vertices := make([]g.Vertex, 0, len(b.reused))
+	for id := range b.reused {
+		vertex, err := g.ReadGsonVertex(b.lines[id])
+		if err != nil {
+			return nil, err
+		}
+		inE := vertex.InE
+		outE := vertex.OutE
+		vertex.InE = nil
+		vertex.OutE = nil
+		for _, edges := range inE {
+			for _, e := range edges {
+				if b.reread[e.OutV] || !b.current[e.OutV] {
+					continue
+				}
+				e.OutVLabel = b.labels[e.OutV]
+				vertex.AddInEdge(e)
+			}
+		}
+		for _, edges := range outE {
+			for _, e := range edges {
+				if b.reread[e.InV] {
+					continue
+				}
+				e.InVLabel = b.labels[e.InV]
+				vertex.AddOutEdge(e)
+			}
+		}
+		vertices = append(vertices, vertex)
+	}
+	return vertices, nil
+}
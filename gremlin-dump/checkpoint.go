@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// CheckpointInterval number of vertices written between checkpoints
+const CheckpointInterval = 1000
+
+func checkpointPath(filePath string) string {
+	return filePath + ".checkpoint"
+}
+
+// saveCheckpoint atomically replaces the checkpoint file
+func saveCheckpoint(path string, c g.GsonCheckpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadCheckpoint(path string) (g.GsonCheckpoint, error) {
+	var c g.GsonCheckpoint
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// openResumed opens the output of an interrupted dump. Anything written
+// after the checkpoint is discarded and the file is positioned at its end.
+func openResumed(filePath string, c g.GsonCheckpoint) (*os.File, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(c.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
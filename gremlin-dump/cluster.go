@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"github.com/willfaught/gockle"
+)
+
+// Cluster is a named cassandra cluster of a multi-cluster dump
+type Cluster struct {
+	Name    string
+	Session gockle.Session
+	index   *fqNameIndex
+}
+
+type clusterConfig struct {
+	name  string
+	hosts []string
+}
+
+// parseClusters parses NAME=HOST[,HOST...] values. Since lists given
+// in environment variables are split on commas, values without a
+// name are added as hosts of the previous cluster.
+func parseClusters(values []string) ([]clusterConfig, error) {
+	configs := make([]clusterConfig, 0)
+	names := make(map[string]bool)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) == 1 {
+			if len(configs) == 0 {
+				return nil, fmt.Errorf("no cluster name for %s", value)
+			}
+			c := &configs[len(configs)-1]
+			c.hosts = append(c.hosts, strings.Split(value, ",")...)
+			continue
+		}
+		if parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid cluster %s, expected NAME=HOST[,HOST...]", value)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("duplicate cluster name %s", parts[0])
+		}
+		names[parts[0]] = true
+		configs = append(configs, clusterConfig{
+			name:  parts[0],
+			hosts: strings.Split(parts[1], ","),
+		})
+	}
+	return configs, nil
+}
+
+// clusterIndex records in which clusters each uuid is a resource,
+// and which cluster first referenced the uuids that are not resources
+type clusterIndex struct {
+	clusters   map[uuid.UUID][]string
+	referenced map[uuid.UUID]string
+	sync.Mutex
+}
+
+func newClusterIndex() *clusterIndex {
+	return &clusterIndex{
+		clusters:   make(map[uuid.UUID][]string),
+		referenced: make(map[uuid.UUID]string),
+	}
+}
+
+// addResource records that id is a resource of cluster
+func (i *clusterIndex) addResource(id uuid.UUID, cluster string) {
+	i.Lock()
+	defer i.Unlock()
+	i.add(id, cluster)
+}
+
+func (i *clusterIndex) add(id uuid.UUID, cluster string) {
+	for _, c := range i.clusters[id] {
+		if c == cluster {
+			return
+		}
+	}
+	i.clusters[id] = append(i.clusters[id], cluster)
+}
+
+// claim records that id was read as a resource of cluster and
+// returns the cluster that owns id, the first one where id is
+// a resource
+func (i *clusterIndex) claim(id uuid.UUID, cluster string) string {
+	i.Lock()
+	defer i.Unlock()
+	i.add(id, cluster)
+	return i.clusters[id][0]
+}
+
+// reference returns the cluster that owns id, a vertex referenced
+// by cluster. When id is not a resource of any cluster, it belongs
+// to the first cluster that referenced it.
+func (i *clusterIndex) reference(id uuid.UUID, cluster string) string {
+	i.Lock()
+	defer i.Unlock()
+	if clusters, ok := i.clusters[id]; ok {
+		return clusters[0]
+	}
+	if c, ok := i.referenced[id]; ok {
+		return c
+	}
+	i.referenced[id] = cluster
+	return cluster
+}
+
+type sharedUUID struct {
+	UUID     uuid.UUID `json:"uuid"`
+	Clusters []string  `json:"clusters"`
+}
+
+// shared lists the uuids that are resources of several clusters
+func (i *clusterIndex) shared() []sharedUUID {
+	i.Lock()
+	defer i.Unlock()
+	r := make([]sharedUUID, 0)
+	for id, clusters := range i.clusters {
+		if len(clusters) > 1 {
+			r = append(r, sharedUUID{UUID: id, Clusters: clusters})
+		}
+	}
+	sort.Slice(r, func(a, b int) bool {
+		return r[a].UUID.String() < r[b].UUID.String()
+	})
+	return r
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+// fqNameIndex tracks obj_fq_name_table entries and the resources
+// found in obj_uuid_table to detect inconsistencies between both tables
+type fqNameIndex struct {
+	entries map[uuid.UUID][]utils.FQNameEntry
+	uuids   map[string][]uuid.UUID
+	found   map[uuid.UUID]bool
+	sync.Mutex
+}
+
+func newFQNameIndex() *fqNameIndex {
+	return &fqNameIndex{
+		entries: make(map[uuid.UUID][]utils.FQNameEntry),
+		uuids:   make(map[string][]uuid.UUID),
+		found:   make(map[uuid.UUID]bool),
+	}
+}
+
+// fqNameKey identifies an fq_name of a given type
+func fqNameKey(entry utils.FQNameEntry) string {
+	return entry.Type + ":" + strings.Join(entry.FQName, ":")
+}
+
+// add records the fq_name/uuid pair of the entry
+func (i *fqNameIndex) add(entry utils.FQNameEntry) {
+	i.Lock()
+	defer i.Unlock()
+	key := fqNameKey(entry)
+	for _, id := range i.uuids[key] {
+		if uuid.Equal(id, entry.UUID) {
+			return
+		}
+	}
+	i.entries[entry.UUID] = append(i.entries[entry.UUID], entry)
+	i.uuids[key] = append(i.uuids[key], entry.UUID)
+}
+
+// setFound marks the resource as present in obj_uuid_table
+// and returns its entry in obj_fq_name_table if any
+func (i *fqNameIndex) setFound(id uuid.UUID) (utils.FQNameEntry, bool) {
+	i.Lock()
+	defer i.Unlock()
+	i.found[id] = true
+	entries, ok := i.entries[id]
+	if !ok {
+		return utils.FQNameEntry{}, false
+	}
+	return entries[0], true
+}
+
+func (i *fqNameIndex) isIndexed(id uuid.UUID) bool {
+	i.Lock()
+	defer i.Unlock()
+	_, ok := i.entries[id]
+	return ok
+}
+
+// list returns one entry for each uuid of the index
+func (i *fqNameIndex) list() []utils.FQNameEntry {
+	i.Lock()
+	defer i.Unlock()
+	entries := make([]utils.FQNameEntry, 0, len(i.entries))
+	for _, e := range i.entries {
+		entries = append(entries, e[0])
+	}
+	return entries
+}
+
+// dangling returns the entries of obj_fq_name_table
+// that have no resource in obj_uuid_table
+func (i *fqNameIndex) dangling() []utils.FQNameEntry {
+	i.Lock()
+	defer i.Unlock()
+	entries := make([]utils.FQNameEntry, 0)
+	for id, e := range i.entries {
+		if !i.found[id] {
+			entries = append(entries, e[0])
+		}
+	}
+	return entries
+}
+
+// annotateConflicts adds the _conflict property to resources that have
+// several fq_names or that share their fq_name with other resources.
+// The fq_names of the resource are listed in _fq_names and the other
+// resources using the same fq_name in _fq_name_uuids.
+func (i *fqNameIndex) annotateConflicts(vertex g.Vertex) (g.Vertex, bool) {
+	i.Lock()
+	defer i.Unlock()
+	entries := i.entries[vertex.ID]
+	conflict := false
+	if len(entries) > 1 {
+		conflict = true
+		for _, e := range entries {
+			vertex.AddProperty("_fq_names", fqNameKey(e))
+		}
+	}
+	for _, e := range entries {
+		for _, id := range i.uuids[fqNameKey(e)] {
+			if !uuid.Equal(id, vertex.ID) {
+				conflict = true
+				vertex.AddProperty("_fq_name_uuids", id.String())
+			}
+		}
+	}
+	if conflict {
+		vertex.AddSingleProperty("_conflict", true)
+	}
+	return vertex, conflict
+}
+
+type uuidConflict struct {
+	UUID    uuid.UUID `json:"uuid"`
+	FQNames []string  `json:"fq_names"`
+}
+
+type fqNameConflict struct {
+	FQName string      `json:"fq_name"`
+	UUIDs  []uuid.UUID `json:"uuids"`
+}
+
+// conflictReport lists the uuids with several fq_names and
+// the fq_names with several uuids found in obj_fq_name_table
+type conflictReport struct {
+	UUIDs   []uuidConflict   `json:"uuids"`
+	FQNames []fqNameConflict `json:"fq_names"`
+}
+
+func (i *fqNameIndex) conflicts() conflictReport {
+	i.Lock()
+	defer i.Unlock()
+	r := conflictReport{
+		UUIDs:   make([]uuidConflict, 0),
+		FQNames: make([]fqNameConflict, 0),
+	}
+	for id, entries := range i.entries {
+		if len(entries) < 2 {
+			continue
+		}
+		c := uuidConflict{UUID: id}
+		for _, e := range entries {
+			c.FQNames = append(c.FQNames, fqNameKey(e))
+		}
+		r.UUIDs = append(r.UUIDs, c)
+	}
+	for key, ids := range i.uuids {
+		if len(ids) > 1 {
+			r.FQNames = append(r.FQNames, fqNameConflict{FQName: key, UUIDs: ids})
+		}
+	}
+	sort.Slice(r.UUIDs, func(a, b int) bool {
+		return r.UUIDs[a].UUID.String() < r.UUIDs[b].UUID.String()
+	})
+	sort.Slice(r.FQNames, func(a, b int) bool {
+		return r.FQNames[a].FQName < r.FQNames[b].FQName
+	})
+	return r
+}
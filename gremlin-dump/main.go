@@ -21,8 +21,10 @@ var (
 )
 
 const (
-	// Readers numbers of workers reading cassandra resources
+	// Readers default number of workers reading cassandra resources
 	Readers = 10
+	// ScanRanges default number of token ranges for full scans
+	ScanRanges = 1024
 )
 
 const (
@@ -30,140 +32,1005 @@ const (
 	ResourceRead
 	ResourceWrite
 	DuplicateVertex
+	UnindexedVertex
+	DanglingEntry
+	MalformedVertex
+	ConflictVertex
+	ReusedVertex
+	ResumedVertex
+	SharedVertex
+	CrossClusterEdge
 	DumpEnd
 )
 
 type Dump struct {
-	session gockle.Session
-	backend *g.GsonBackend
-	uuids   chan uuid.UUID
-	report  chan int64
-	wg      *sync.WaitGroup
+	session      gockle.Session
+	api          *utils.ContrailAPIReader
+	csvResources io.Reader
+	csvEntries   io.Reader
+	backend      *g.GsonBackend
+	entries      chan utils.FQNameEntry
+	report       chan int64
+	scanRanges   int
+	readers      int
+	limiter      *utils.AdaptiveLimiter
+	index        *fqNameIndex
+	base         *baseDump
+	resumed      map[uuid.UUID]bool
+	malformed    *malformedReport
+	cluster      string
+	clusters     []*Cluster
+	shared       *clusterIndex
+	stats        *dumpStats
+	wg           *sync.WaitGroup
 }
 
-func NewDump(session gockle.Session, output io.Writer) Dump {
+// NewDump returns a dump process. When scanRanges is greater than 0
+// obj_uuid_table is read directly, split in scanRanges token ranges.
+// When checkIndex is true, resources missing from obj_fq_name_table
+// and obj_fq_name_table entries without resource are dumped as well.
+func NewDump(session gockle.Session, output io.Writer, scanRanges int, checkIndex bool) Dump {
 	d := Dump{
-		session: session,
-		backend: g.NewGsonBackend(output),
-		uuids:   make(chan uuid.UUID),
-		report:  make(chan int64),
-		wg:      &sync.WaitGroup{},
+		session:    session,
+		backend:    g.NewGsonBackend(output),
+		entries:    make(chan utils.FQNameEntry),
+		report:     make(chan int64),
+		scanRanges: scanRanges,
+		readers:    Readers,
+		malformed:  newMalformedReport(),
+		stats:      newDumpStats(),
+		resumed:    make(map[uuid.UUID]bool),
+		wg:         &sync.WaitGroup{},
+	}
+	if checkIndex {
+		d.index = newFQNameIndex()
 	}
-	d.backend.Start()
 	return d
 }
 
-func (d Dump) Start() {
-	go d.reportCount()
-	for w := 1; w <= Readers; w++ {
-		go d.processResource()
+// NewAPIDump returns a dump process reading resources from the contrail-api
+func NewAPIDump(api *utils.ContrailAPIReader, output io.Writer) Dump {
+	d := NewDump(nil, output, 0, false)
+	d.api = api
+	return d
+}
+
+// NewCSVDump returns a dump process reading cqlsh exports of obj_uuid_table
+// and optionally obj_fq_name_table. When the obj_fq_name_table export is
+// given, both tables are checked like with checkIndex.
+func NewCSVDump(resources io.Reader, entries io.Reader, output io.Writer) Dump {
+	d := NewDump(nil, output, 0, entries != nil)
+	d.csvResources = resources
+	d.csvEntries = entries
+	return d
+}
+
+// NewIncrementalDump returns a dump process that only reads the resources
+// added or modified since the base dump. Other resources are copied
+// from the base dump.
+func NewIncrementalDump(session gockle.Session, base io.Reader, output io.Writer) (Dump, error) {
+	b, err := loadBase(base)
+	if err != nil {
+		return Dump{}, err
 	}
+	d := NewDump(session, output, 0, false)
+	d.base = b
+	// the edges of reused resources with resources read again are
+	// dropped, they are taken from the resources read again
+	d.backend.SetMergePendingEdges(true)
+	return d, nil
+}
+
+// NewMultiClusterDump returns a dump process reading several cassandra
+// clusters, one after the other, in the same output. Each vertex has
+// a cluster property with the name of its cluster. Since all clusters
+// go through the same backend, edge and property IDs don't collide.
+// A uuid belongs to the first cluster where it is a resource, or when
+// it is only referenced, to the first cluster that references it.
+// Resources and edges of other clusters with that uuid are reported
+// and not written, so that the subgraphs of the clusters stay separate.
+func NewMultiClusterDump(clusters []*Cluster, output io.Writer, scanRanges int, checkIndex bool) Dump {
+	d := NewDump(nil, output, scanRanges, checkIndex)
+	d.clusters = clusters
+	d.shared = newClusterIndex()
+	return d
+}
+
+// WithReaders returns the dump using the given number of readers.
+// When limiter is not nil, it adjusts the number of concurrent reads
+// of resources to the cassandra latency.
+func (d Dump) WithReaders(readers int, limiter *utils.AdaptiveLimiter) Dump {
+	d.readers = readers
+	d.limiter = limiter
+	return d
+}
+
+// EnableCheckpoints saves the state of the dump to path
+// every CheckpointInterval vertices
+func (d Dump) EnableCheckpoints(path string) {
+	d.backend.SetCheckpoint(CheckpointInterval, func(c g.GsonCheckpoint) {
+		if err := saveCheckpoint(path, c); err != nil {
+			log.Warningf("Failed to save checkpoint %s: %s", path, err)
+		}
+	})
+}
+
+// Resume restores the state of an interrupted dump from its output.
+// Resources already written are not written again.
+func (d Dump) Resume(output io.Reader, c g.GsonCheckpoint) error {
+	ids, err := d.backend.Resume(output, c)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		d.resumed[id] = true
+	}
+	log.Noticef("Resuming dump after %d resources", len(ids))
+	return nil
+}
+
+// Start runs the dump and returns when all resources are written
+func (d Dump) Start() error {
+	var err error
+	d.backend.Start()
+	go d.reportCount()
 	start := time.Now()
 	d.report <- DumpStart
-	err := d.getResources()
-	if err != nil {
-		log.Panicf("Dump failed: %s", err)
+	if d.clusters != nil {
+		err = d.readClusters()
+	} else {
+		err = d.read()
 	}
 	end := time.Now().Sub(start)
 	d.report <- DumpEnd
 	d.wg.Wait()
 	d.backend.Stop()
+	close(d.report)
 	fmt.Println()
+	if err != nil {
+		return err
+	}
+	d.stats.finish(end, d.backend.Missing())
 	log.Noticef("Dump done in %0.2fs", end.Seconds())
+	return nil
 }
 
-func (d Dump) reportCount() {
-	readCount := 0
-	writeCount := 0
-	duplicateCount := 0
+func (d Dump) read() error {
+	var err error
+	switch {
+	case d.api != nil:
+		err = d.getAPIResources()
+	case d.csvResources != nil:
+		err = d.readCSVResources()
+	case d.scanRanges > 0:
+		err = d.scanResources()
+	default:
+		err = d.getResources()
+	}
+	if err == nil && d.index != nil {
+		d.writeDanglingEntries()
+	}
+	return err
+}
+
+// readClusters reads each cluster with its own session
+// and obj_fq_name_table index. The uuids of the resources of
+// all clusters are listed first, so that a cluster doesn't
+// claim the resources of the next ones that it references.
+func (d Dump) readClusters() error {
+	for _, c := range d.clusters {
+		if err := d.listClusterResources(c); err != nil {
+			return fmt.Errorf("cluster %s: %s", c.Name, err)
+		}
+	}
+	for _, c := range d.clusters {
+		cd := d
+		cd.session = c.Session
+		cd.cluster = c.Name
+		cd.entries = make(chan utils.FQNameEntry)
+		if d.index != nil {
+			c.index = newFQNameIndex()
+			cd.index = c.index
+		}
+		if err := cd.read(); err != nil {
+			return fmt.Errorf("cluster %s: %s", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// listClusterResources records the uuids of the resources of the
+// cluster: the keys of obj_uuid_table when the dump reads them all,
+// the obj_fq_name_table entries otherwise.
+func (d Dump) listClusterResources(c *Cluster) error {
+	uuids := make(chan uuid.UUID)
+	errs := make(chan error, 1)
+	go func() {
+		if d.scanRanges > 0 || d.index != nil {
+			errs <- utils.GetContrailUUIDTableKeys(c.Session, uuids)
+		} else {
+			errs <- utils.GetContrailUUIDs(c.Session, uuids)
+		}
+		close(uuids)
+	}()
+	for id := range uuids {
+		d.shared.addResource(id, c.Name)
+	}
+	return <-errs
+}
 
+// conflicts returns the fq_name conflicts of the
+// index, by cluster in a multi-cluster dump
+func (d Dump) conflicts() interface{} {
+	if d.clusters == nil {
+		return d.index.conflicts()
+	}
+	r := make(map[string]conflictReport)
+	for _, c := range d.clusters {
+		r[c.Name] = c.index.conflicts()
+	}
+	return r
+}
+
+func (d Dump) reportCount() {
 	dumpStatus := `W`
 
 	for c := range d.report {
 		switch c {
-		case ResourceRead:
-			readCount++
-		case ResourceWrite:
-			writeCount++
-		case DuplicateVertex:
-			duplicateCount++
 		case DumpStart:
 			dumpStatus = `R`
 		case DumpEnd:
 			dumpStatus = `D`
 		}
-		fmt.Printf("\rProcessing [read:%d write:%d dup:%d] %s",
-			readCount, writeCount, duplicateCount, dumpStatus)
+		d.stats.count(c)
+		fmt.Printf("\rProcessing [%s] %s", d.stats.progress(), dumpStatus)
 	}
 }
 
 func (d Dump) processResource() {
-	d.wg.Add(1)
 	defer d.wg.Done()
-	for uuid := range d.uuids {
-		vertex, err := utils.GetContrailResource(d.session, uuid)
+	for entry := range d.entries {
+		if d.resumed[entry.UUID] {
+			if d.index != nil {
+				d.index.setFound(entry.UUID)
+			}
+			d.report <- ResumedVertex
+			continue
+		}
+		if d.base != nil && d.base.reuse(d.session, entry.UUID) {
+			continue
+		}
+		vertex, err := d.getResource(entry.UUID)
+		// only a resource without any row is considered dangling
+		if err != utils.ErrResourceNotFound && d.index != nil {
+			d.index.setFound(entry.UUID)
+		}
 		if err != nil {
 			log.Warningf("%s", err)
 		} else {
-			d.report <- ResourceRead
-			err := d.backend.Create(vertex)
-			if err != nil {
-				d.report <- DuplicateVertex
-			} else {
-				d.report <- ResourceWrite
+			d.writeResource(utils.InferFromFQNameEntry(vertex, entry))
+		}
+	}
+}
+
+func (d Dump) getResource(id uuid.UUID) (g.Vertex, error) {
+	if d.limiter == nil {
+		return utils.GetContrailResource(d.session, id)
+	}
+	d.limiter.Acquire()
+	start := time.Now()
+	vertex, err := utils.GetContrailResource(d.session, id)
+	if err == utils.ErrResourceNotFound {
+		d.limiter.Release(time.Since(start), nil)
+	} else {
+		d.limiter.Release(time.Since(start), err)
+	}
+	return vertex, err
+}
+
+func (d Dump) writeResource(vertex g.Vertex) {
+	if d.resumed[vertex.ID] {
+		d.report <- ResumedVertex
+		return
+	}
+	d.report <- ResourceRead
+	vertex, ok := d.tagCluster(vertex)
+	if !ok {
+		return
+	}
+	vertex = d.checkConflicts(vertex)
+	if vertex.HasProp("_malformed") {
+		d.malformed.add(vertex)
+		d.report <- MalformedVertex
+	}
+	err := d.backend.Create(vertex)
+	if err != nil {
+		d.report <- DuplicateVertex
+	} else {
+		d.stats.addVertex(vertex)
+		d.report <- ResourceWrite
+	}
+}
+
+// writeScanned writes a resource read from a full obj_uuid_table
+// scan. Since obj_fq_name_table entries have been loaded before,
+// unindexed resources can be flagged directly.
+func (d Dump) writeScanned(vertex g.Vertex) {
+	if d.index == nil {
+		d.writeResource(vertex)
+	} else if entry, ok := d.index.setFound(vertex.ID); ok {
+		d.writeResource(utils.InferFromFQNameEntry(vertex, entry))
+	} else {
+		d.writeUnindexed(vertex)
+	}
+}
+
+// writeUnindexed writes a resource that has no obj_fq_name_table entry
+func (d Dump) writeUnindexed(vertex g.Vertex) {
+	vertex.AddSingleProperty("_unindexed", true)
+	d.report <- UnindexedVertex
+	d.writeResource(vertex)
+}
+
+// writeDangling writes a vertex for an obj_fq_name_table
+// entry that has no resource in obj_uuid_table
+func (d Dump) writeDangling(entry utils.FQNameEntry) {
+	if d.resumed[entry.UUID] {
+		d.report <- ResumedVertex
+		return
+	}
+	vertex := g.Vertex{
+		ID:    entry.UUID,
+		Label: entry.Type,
+	}
+	vertex.AddSingleProperty("fq_name", entry.FQName)
+	vertex.AddSingleProperty("_missing", true)
+	vertex.AddSingleProperty("_dangling", true)
+	vertex, ok := d.tagClusterDangling(vertex)
+	if !ok {
+		return
+	}
+	vertex = d.checkConflicts(vertex)
+	d.report <- DanglingEntry
+	if err := d.backend.Create(vertex); err != nil {
+		d.report <- DuplicateVertex
+	} else {
+		d.stats.addVertex(vertex)
+		d.report <- ResourceWrite
+	}
+}
+
+// tagCluster adds the cluster of the resource in a multi-cluster
+// dump. It returns false when the uuid of the resource belongs to
+// another cluster. Edges with vertices of another cluster are
+// removed.
+func (d Dump) tagCluster(vertex g.Vertex) (g.Vertex, bool) {
+	if d.cluster == "" {
+		return vertex, true
+	}
+	if d.shared.claim(vertex.ID, d.cluster) != d.cluster {
+		d.report <- SharedVertex
+		return vertex, false
+	}
+	vertex.AddSingleProperty("cluster", d.cluster)
+	d.clusterEdges(vertex.OutE, func(e g.Edge) uuid.UUID { return e.InV })
+	d.clusterEdges(vertex.InE, func(e g.Edge) uuid.UUID { return e.OutV })
+	return vertex, true
+}
+
+// tagClusterDangling adds the cluster of a dangling entry. Since it
+// is not a resource, it returns false without reporting when the
+// uuid belongs to another cluster.
+func (d Dump) tagClusterDangling(vertex g.Vertex) (g.Vertex, bool) {
+	if d.cluster == "" {
+		return vertex, true
+	}
+	if d.shared.reference(vertex.ID, d.cluster) != d.cluster {
+		return vertex, false
+	}
+	vertex.AddSingleProperty("cluster", d.cluster)
+	return vertex, true
+}
+
+// clusterEdges removes the edges whose other vertex
+// doesn't belong to the cluster of the dump
+func (d Dump) clusterEdges(edges map[string][]g.Edge, other func(g.Edge) uuid.UUID) {
+	for label, es := range edges {
+		kept := make([]g.Edge, 0, len(es))
+		for _, e := range es {
+			if d.shared.reference(other(e), d.cluster) != d.cluster {
+				d.report <- CrossClusterEdge
+				continue
 			}
+			kept = append(kept, e)
+		}
+		if len(kept) == 0 {
+			delete(edges, label)
+		} else {
+			edges[label] = kept
 		}
 	}
 }
 
+// checkConflicts annotates resources involved in fq_name conflicts
+func (d Dump) checkConflicts(vertex g.Vertex) g.Vertex {
+	if d.index == nil {
+		return vertex
+	}
+	vertex, conflict := d.index.annotateConflicts(vertex)
+	if conflict {
+		d.report <- ConflictVertex
+	}
+	return vertex
+}
+
 func (d Dump) getResources() error {
-	defer close(d.uuids)
-	err := utils.GetContrailUUIDs(d.session, d.uuids)
+	for w := 1; w <= d.readers; w++ {
+		d.wg.Add(1)
+		go d.processResource()
+	}
+	var err error
+	if d.index != nil {
+		// all entries are loaded first so that fq_name conflicts
+		// are known when resources are written
+		err = d.loadIndex(func(entries chan utils.FQNameEntry) error {
+			return utils.GetContrailFQNameEntries(d.session, entries)
+		})
+		if err == nil {
+			for _, entry := range d.index.list() {
+				d.entries <- entry
+			}
+		}
+	} else {
+		err = utils.GetContrailFQNameEntries(d.session, d.entries)
+	}
+	close(d.entries)
+	d.wg.Wait()
+	if err == nil && d.base != nil {
+		err = d.writeReused()
+	}
+	if err == nil && d.index != nil {
+		err = d.getUnindexedResources()
+	}
+	return err
+}
+
+// writeReused writes the resources taken from the base dump. They are
+// written last so that their edges with resources that were read
+// again are rebuilt by the backend.
+func (d Dump) writeReused() error {
+	vertices, err := d.base.reusedVertices()
 	if err != nil {
 		return err
 	}
+	for _, vertex := range vertices {
+		d.report <- ReusedVertex
+		d.writeResource(vertex)
+	}
 	return nil
 }
 
-func setup(cassandraCluster []string, filePath string) {
+// loadIndex reads all obj_fq_name_table entries before resources
+func (d Dump) loadIndex(list func(chan utils.FQNameEntry) error) error {
+	entries := make(chan utils.FQNameEntry)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- list(entries)
+		close(entries)
+	}()
+	for entry := range entries {
+		d.index.add(entry)
+	}
+	return <-errs
+}
+
+// writeDanglingEntries writes obj_fq_name_table entries that have no resource
+func (d Dump) writeDanglingEntries() {
+	for _, entry := range d.index.dangling() {
+		d.writeDangling(entry)
+	}
+}
+
+func (d Dump) getUnindexedResources() error {
+	uuids := make(chan uuid.UUID)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- utils.GetContrailUUIDTableKeys(d.session, uuids)
+		close(uuids)
+	}()
+	for id := range uuids {
+		if d.index.isIndexed(id) {
+			continue
+		}
+		vertex, err := d.getResource(id)
+		if err != nil {
+			log.Warningf("%s", err)
+			continue
+		}
+		d.index.setFound(id)
+		d.writeUnindexed(vertex)
+	}
+	return <-errs
+}
+
+// scanResources reads obj_uuid_table token ranges in parallel
+// and writes vertices as they are built
+func (d Dump) scanResources() error {
+	if d.index != nil {
+		err := d.loadIndex(func(entries chan utils.FQNameEntry) error {
+			return utils.GetContrailFQNameEntries(d.session, entries)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	ranges := make(chan utils.TokenRange, d.scanRanges)
+	for _, r := range utils.SplitTokenRing(d.scanRanges) {
+		ranges <- r
+	}
+	close(ranges)
+
+	vertices := make(chan g.Vertex)
+	errs := make(chan error, d.readers)
+	scanners := &sync.WaitGroup{}
+	for w := 1; w <= d.readers; w++ {
+		scanners.Add(1)
+		go func() {
+			defer scanners.Done()
+			for r := range ranges {
+				if err := utils.ScanContrailResources(d.session, r, vertices); err != nil {
+					errs <- fmt.Errorf("scan of range [%d, %d] failed: %s", r.Start, r.End, err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		scanners.Wait()
+		close(vertices)
+		close(errs)
+	}()
+
+	for vertex := range vertices {
+		d.writeScanned(vertex)
+	}
+	return <-errs
+}
+
+// readCSVResources reads resources from cqlsh exports
+func (d Dump) readCSVResources() error {
+	if d.index != nil {
+		err := d.loadIndex(func(entries chan utils.FQNameEntry) error {
+			return utils.ReadCSVFQNameEntries(d.csvEntries, entries)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	vertices := make(chan g.Vertex)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- utils.ReadCSVResources(d.csvResources, vertices)
+		close(vertices)
+	}()
+	for vertex := range vertices {
+		d.writeScanned(vertex)
+	}
+	return <-errs
+}
+
+// getAPIResources reads resources of each type from the contrail-api
+func (d Dump) getAPIResources() error {
+	resTypes, err := d.api.Types()
+	if err != nil {
+		return err
+	}
+	types := make(chan string, len(resTypes))
+	for _, t := range resTypes {
+		types <- t
+	}
+	close(types)
+
+	vertices := make(chan g.Vertex)
+	errs := make(chan error, d.readers)
+	readers := &sync.WaitGroup{}
+	for w := 1; w <= d.readers; w++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for t := range types {
+				if err := d.api.GetResources(t, vertices); err != nil {
+					errs <- fmt.Errorf("failed to list %s resources: %s", t, err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		readers.Wait()
+		close(vertices)
+		close(errs)
+	}()
+
+	for vertex := range vertices {
+		d.writeResource(vertex)
+	}
+	return <-errs
+}
+
+func setup(source string, cassandraCluster []string, clusters []string, contrailAPIURL string, contrailAPIToken string, csvUUIDTable string, csvFQNameTable string, filePath string, scanRanges int, checkIndex bool, basePath string, resume bool, readers int, maxQPS int, adaptiveLatency time.Duration, statsPath string, malformedReport string, conflictReport string, clusterReport string, every time.Duration, dir string, keep int, compress bool) {
 	var (
 		session gockle.Session
 		err     error
 	)
 
-	log.Notice("Connecting to Cassandra...")
-	session, err = utils.SetupCassandra(cassandraCluster)
+	if basePath != "" && (source != "cassandra" || scanRanges > 0 || checkIndex) {
+		log.Fatal("--base only applies to the cassandra source without --full-scan and --check-index")
+	}
+	if basePath != "" && basePath == filePath {
+		log.Fatal("--base must be different from the output file")
+	}
+	if every > 0 && (dir == "" || resume || keep < 1) {
+		log.Fatal("--every needs --dir and --keep of at least 1, and can't be used with --resume")
+	}
+	if every == 0 && filePath == "" {
+		log.Fatal("DST is required without --every")
+	}
+	if len(clusters) > 0 && (source != "cassandra" || basePath != "" || resume) {
+		log.Fatal("--cluster only applies to the cassandra source without --base and --resume")
+	}
+	// range scans and API listings are not single resource reads
+	if adaptiveLatency > 0 && (source != "cassandra" || scanRanges > 0) {
+		log.Fatal("--adaptive only applies to the cassandra source without --full-scan")
+	}
+	// conflicts are only found when obj_fq_name_table is indexed
+	indexed := (source == "cassandra" && checkIndex) || (source == "csv" && csvFQNameTable != "")
+	if conflictReport != "" && !indexed {
+		log.Fatal("--conflict-report needs --check-index, or --csv-fq-name-table with the csv source")
+	}
+	configs, err := parseClusters(clusters)
 	if err != nil {
-		log.Fatalf("Failed to connect to Cassandra: %s", err)
+		log.Fatalf("Invalid --cluster: %s", err)
 	}
-	log.Notice("Connected.")
-	defer session.Close()
 
-	f, err := os.Create(filePath)
-	if err != nil {
-		log.Fatalf("Failed to open file %s: %s", filePath, err)
+	var multi []*Cluster
+	for _, c := range configs {
+		log.Noticef("Connecting to Cassandra cluster %s...", c.name)
+		s, err := utils.SetupCassandra(c.hosts)
+		if err != nil {
+			log.Fatalf("Failed to connect to Cassandra cluster %s: %s", c.name, err)
+		}
+		defer s.Close()
+		if maxQPS > 0 {
+			s = utils.NewRateLimitedSession(s, maxQPS)
+		}
+		multi = append(multi, &Cluster{Name: c.name, Session: s})
+	}
+	if multi != nil {
+		log.Notice("Connected.")
+	} else if source == "cassandra" {
+		log.Notice("Connecting to Cassandra...")
+		session, err = utils.SetupCassandra(cassandraCluster)
+		if err != nil {
+			log.Fatalf("Failed to connect to Cassandra: %s", err)
+		}
+		log.Notice("Connected.")
+		defer session.Close()
+		if maxQPS > 0 {
+			session = utils.NewRateLimitedSession(session, maxQPS)
+		}
+	}
+
+	// runDump dumps to output. filePath is the final path of the dump,
+	// used for the default stats path. When checkpoint is not nil, the
+	// dump is resumed from what was already written, read from input.
+	runDump := func(output io.Writer, filePath string, input io.Reader, checkpoint *g.GsonCheckpoint) error {
+		var d Dump
+		switch source {
+		case "cassandra":
+			if multi != nil {
+				d = NewMultiClusterDump(multi, output, scanRanges, checkIndex)
+				break
+			}
+			if basePath == "" {
+				d = NewDump(session, output, scanRanges, checkIndex)
+				break
+			}
+			base, err := os.Open(basePath)
+			if err != nil {
+				return fmt.Errorf("failed to open file %s: %s", basePath, err)
+			}
+			defer base.Close()
+			log.Noticef("Loading base dump %s...", basePath)
+			d, err = NewIncrementalDump(session, base, output)
+			if err != nil {
+				return fmt.Errorf("failed to load base dump %s: %s", basePath, err)
+			}
+		case "contrail-api":
+			d = NewAPIDump(utils.NewContrailAPIReader(contrailAPIURL, contrailAPIToken), output)
+		case "csv":
+			resources, err := os.Open(csvUUIDTable)
+			if err != nil {
+				return fmt.Errorf("failed to open file %s: %s", csvUUIDTable, err)
+			}
+			defer resources.Close()
+			var entries io.Reader
+			if csvFQNameTable != "" {
+				fqNames, err := os.Open(csvFQNameTable)
+				if err != nil {
+					return fmt.Errorf("failed to open file %s: %s", csvFQNameTable, err)
+				}
+				defer fqNames.Close()
+				entries = fqNames
+			}
+			d = NewCSVDump(resources, entries, output)
+		default:
+			return fmt.Errorf("unknown source %s", source)
+		}
+		var limiter *utils.AdaptiveLimiter
+		if adaptiveLatency > 0 {
+			limiter = utils.NewAdaptiveLimiter(readers, adaptiveLatency)
+		}
+		d = d.WithReaders(readers, limiter)
+		// checkpoints can't be used with the rotation mode since
+		// dumps can be compressed and are written to a temporary file
+		if every == 0 {
+			checkpointFile := checkpointPath(filePath)
+			if checkpoint != nil {
+				if err := d.Resume(input, *checkpoint); err != nil {
+					return fmt.Errorf("failed to resume dump %s: %s", filePath, err)
+				}
+			}
+			d.EnableCheckpoints(checkpointFile)
+			defer os.Remove(checkpointFile)
+		}
+		if err := d.Start(); err != nil {
+			return err
+		}
+
+		statsFile := statsPath
+		if statsFile == "" {
+			statsFile = filePath + ".stats.json"
+		}
+		if err := d.stats.write(statsFile); err != nil {
+			log.Errorf("Failed to write stats %s: %s", statsFile, err)
+		}
+
+		if malformedReport != "" {
+			if err := d.malformed.write(malformedReport); err != nil {
+				log.Errorf("Failed to write report %s: %s", malformedReport, err)
+			}
+		}
+		if conflictReport != "" {
+			if err := writeJSONReport(conflictReport, d.conflicts()); err != nil {
+				log.Errorf("Failed to write report %s: %s", conflictReport, err)
+			}
+		}
+		if d.shared != nil {
+			shared := d.shared.shared()
+			if len(shared) > 0 {
+				log.Warningf("%d uuids found in several clusters", len(shared))
+			}
+			if clusterReport != "" {
+				if err := writeJSONReport(clusterReport, shared); err != nil {
+					log.Errorf("Failed to write report %s: %s", clusterReport, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if every > 0 {
+		log.Noticef("Dumping every %s to %s", every, dir)
+		newRotation(dir, keep, compress).loop(every, func(output io.Writer, filePath string) error {
+			return runDump(output, filePath, nil, nil)
+		})
+		return
+	}
+
+	var (
+		f          *os.File
+		checkpoint *g.GsonCheckpoint
+	)
+	checkpointFile := checkpointPath(filePath)
+	if resume {
+		c, err := loadCheckpoint(checkpointFile)
+		switch {
+		case err == nil:
+			f, err = openResumed(filePath, c)
+			if err != nil {
+				log.Fatalf("Failed to open file %s: %s", filePath, err)
+			}
+			checkpoint = &c
+		case os.IsNotExist(err):
+			log.Warningf("No checkpoint %s found, starting a new dump", checkpointFile)
+		default:
+			log.Fatalf("Failed to load checkpoint %s: %s", checkpointFile, err)
+		}
+	}
+	if f == nil {
+		f, err = os.Create(filePath)
+		if err != nil {
+			log.Fatalf("Failed to open file %s: %s", filePath, err)
+		}
 	}
 	defer f.Close()
 
-	d := NewDump(session, f)
-	d.Start()
+	if err := runDump(f, filePath, f, checkpoint); err != nil {
+		log.Fatalf("Dump failed: %s", err)
+	}
 }
 
 func main() {
 	app := cli.App(os.Args[0], "Dump Contrail DB to GraphSON file")
+	source := app.String(cli.StringOpt{
+		Name:   "source",
+		Value:  "cassandra",
+		Desc:   "where to read contrail resources from (cassandra, contrail-api or csv)",
+		EnvVar: "GREMLIN_DUMP_SOURCE",
+	})
 	cassandraSrvs := app.Strings(cli.StringsOpt{
 		Name:   "cassandra",
 		Value:  []string{"localhost"},
 		Desc:   "list of host of cassandra nodes, uses CQL port 9042",
 		EnvVar: "GREMLIN_DUMP_CASSANDRA_SERVERS",
 	})
+	clusters := app.Strings(cli.StringsOpt{
+		Name:   "cluster",
+		Value:  []string{},
+		Desc:   "named cassandra cluster NAME=HOST[,HOST...], repeat to dump several clusters in the same file",
+		EnvVar: "GREMLIN_DUMP_CLUSTERS",
+	})
+	contrailAPISrv := app.String(cli.StringOpt{
+		Name:   "contrail-api",
+		Value:  "localhost:8082",
+		Desc:   "host:port of contrail-api server",
+		EnvVar: "GREMLIN_DUMP_CONTRAIL_API_SERVER",
+	})
+	contrailAPIToken := app.String(cli.StringOpt{
+		Name:   "contrail-api-token",
+		Desc:   "keystone token for contrail-api server",
+		EnvVar: "GREMLIN_DUMP_CONTRAIL_API_TOKEN",
+	})
+	csvUUIDTable := app.String(cli.StringOpt{
+		Name:   "csv-uuid-table",
+		Desc:   "cqlsh export of obj_uuid_table for the csv source",
+		EnvVar: "GREMLIN_DUMP_CSV_UUID_TABLE",
+	})
+	csvFQNameTable := app.String(cli.StringOpt{
+		Name:   "csv-fq-name-table",
+		Desc:   "cqlsh export of obj_fq_name_table for the csv source, enables index checks",
+		EnvVar: "GREMLIN_DUMP_CSV_FQ_NAME_TABLE",
+	})
+	fullScan := app.Bool(cli.BoolOpt{
+		Name:   "full-scan",
+		Value:  false,
+		Desc:   "read obj_uuid_table directly instead of going through obj_fq_name_table",
+		EnvVar: "GREMLIN_DUMP_FULL_SCAN",
+	})
+	scanRanges := app.Int(cli.IntOpt{
+		Name:   "scan-ranges",
+		Value:  ScanRanges,
+		Desc:   "number of token ranges read in parallel in full scan mode",
+		EnvVar: "GREMLIN_DUMP_SCAN_RANGES",
+	})
+	checkIndex := app.Bool(cli.BoolOpt{
+		Name:   "check-index",
+		Value:  false,
+		Desc:   "dump resources missing from obj_fq_name_table and obj_fq_name_table entries without resource",
+		EnvVar: "GREMLIN_DUMP_CHECK_INDEX",
+	})
+	basePath := app.String(cli.StringOpt{
+		Name:   "base",
+		Desc:   "previous dump file, only resources added or modified since are read",
+		EnvVar: "GREMLIN_DUMP_BASE",
+	})
+	resume := app.Bool(cli.BoolOpt{
+		Name:   "resume",
+		Value:  false,
+		Desc:   "resume an interrupted dump from its checkpoint",
+		EnvVar: "GREMLIN_DUMP_RESUME",
+	})
+	readers := app.Int(cli.IntOpt{
+		Name:   "readers",
+		Value:  Readers,
+		Desc:   "number of concurrent readers",
+		EnvVar: "GREMLIN_DUMP_READERS",
+	})
+	maxQPS := app.Int(cli.IntOpt{
+		Name:   "max-qps",
+		Value:  0,
+		Desc:   "maximum number of cassandra queries per second (0 for no limit)",
+		EnvVar: "GREMLIN_DUMP_MAX_QPS",
+	})
+	adaptive := app.Bool(cli.BoolOpt{
+		Name:   "adaptive",
+		Value:  false,
+		Desc:   "reduce the number of concurrent reads when cassandra is slow or failing (not with --full-scan)",
+		EnvVar: "GREMLIN_DUMP_ADAPTIVE",
+	})
+	adaptiveLatency := app.Int(cli.IntOpt{
+		Name:   "adaptive-latency",
+		Value:  200,
+		Desc:   "target latency in ms of resource reads in adaptive mode",
+		EnvVar: "GREMLIN_DUMP_ADAPTIVE_LATENCY",
+	})
+	statsPath := app.String(cli.StringOpt{
+		Name:   "stats",
+		Desc:   "write the dump statistics to this file (default DST.stats.json)",
+		EnvVar: "GREMLIN_DUMP_STATS",
+	})
+	malformedReport := app.String(cli.StringOpt{
+		Name:   "malformed-report",
+		Desc:   "write a JSON report of resources with malformed columns to this file",
+		EnvVar: "GREMLIN_DUMP_MALFORMED_REPORT",
+	})
+	conflictReport := app.String(cli.StringOpt{
+		Name:   "conflict-report",
+		Desc:   "write a JSON report of fq_name conflicts to this file (needs the obj_fq_name_table index)",
+		EnvVar: "GREMLIN_DUMP_CONFLICT_REPORT",
+	})
+	clusterReport := app.String(cli.StringOpt{
+		Name:   "cluster-report",
+		Desc:   "write a JSON report of uuids found in several clusters to this file",
+		EnvVar: "GREMLIN_DUMP_CLUSTER_REPORT",
+	})
+	every := app.String(cli.StringOpt{
+		Name:   "every",
+		Desc:   "run as a daemon and dump at this interval (eg: 1h) in --dir",
+		EnvVar: "GREMLIN_DUMP_EVERY",
+	})
+	dir := app.String(cli.StringOpt{
+		Name:   "dir",
+		Desc:   "directory of the timestamped dumps in daemon mode",
+		EnvVar: "GREMLIN_DUMP_DIR",
+	})
+	keep := app.Int(cli.IntOpt{
+		Name:   "keep",
+		Value:  24,
+		Desc:   "number of dumps kept in daemon mode",
+		EnvVar: "GREMLIN_DUMP_KEEP",
+	})
+	compress := app.Bool(cli.BoolOpt{
+		Name:   "compress",
+		Value:  false,
+		Desc:   "gzip the dumps in daemon mode",
+		EnvVar: "GREMLIN_DUMP_COMPRESS",
+	})
 	filePath := app.String(cli.StringArg{
 		Name: "DST",
 		Desc: "Output file path",
 	})
+	app.Spec = "[OPTIONS] [DST]"
+
 	utils.SetupLogging(app, log)
 	app.Action = func() {
-		setup(*cassandraSrvs, *filePath)
+		ranges := 0
+		if *fullScan {
+			ranges = *scanRanges
+		}
+		if *readers < 1 {
+			log.Fatal("--readers must be at least 1")
+		}
+		latency := time.Duration(0)
+		if *adaptive {
+			latency = time.Duration(*adaptiveLatency) * time.Millisecond
+		}
+		interval := time.Duration(0)
+		if *every != "" {
+			var err error
+			if interval, err = time.ParseDuration(*every); err != nil || interval <= 0 {
+				log.Fatalf("Invalid --every %s", *every)
+			}
+		}
+		contrailAPIURL := fmt.Sprintf("http://%s", *contrailAPISrv)
+		setup(*source, *cassandraSrvs, *clusters, contrailAPIURL, *contrailAPIToken,
+			*csvUUIDTable, *csvFQNameTable, *filePath, ranges, *checkIndex,
+			*basePath, *resume, *readers, *maxQPS, latency, *statsPath,
+			*malformedReport, *conflictReport, *clusterReport,
+			interval, *dir, *keep, *compress)
 	}
 	app.Run(os.Args)
 }
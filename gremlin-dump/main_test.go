@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maraino/go-mock"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+func csvBlob(value string) string {
+	return "0x" + hex.EncodeToString([]byte(value))
+}
+
+type dumpVertex struct {
+	ID struct {
+		Value string `json:"@value"`
+	} `json:"id"`
+	Label      string                   `json:"label"`
+	Properties map[string][]interface{} `json:"properties"`
+	InE        map[string][]interface{} `json:"inE"`
+	OutE       map[string][]interface{} `json:"outE"`
+}
+
+func readDump(t *testing.T, output *bytes.Buffer) map[string]dumpVertex {
+	vertices := make(map[string]dumpVertex)
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		var v dumpVertex
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			t.Fatalf("Invalid dump line %s: %s", scanner.Text(), err)
+		}
+		vertices[v.ID.Value] = v
+	}
+	return vertices
+}
+
+func TestCSVDump(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	id4, _ := uuid.NewV4()
+	resources := strings.Join([]string{
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id1.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""vn1""]"`, csvBlob(id1.String()), csvBlob("fq_name")),
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id2.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""vn2""]"`, csvBlob(id2.String()), csvBlob("fq_name")),
+		fmt.Sprintf(`%s,%s,"""vn4"""`, csvBlob(id4.String()), csvBlob("prop:display_name")),
+	}, "\n")
+	entries := strings.Join([]string{
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn1:"+id1.String())),
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn3:"+id3.String())),
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn4:"+id4.String())),
+	}, "\n")
+
+	var output bytes.Buffer
+	d := NewCSVDump(strings.NewReader(resources), strings.NewReader(entries), &output)
+	d.Start()
+
+	vertices := readDump(t, &output)
+	assert.Equal(t, 4, len(vertices))
+	assert.NotContains(t, vertices[id1.String()].Properties, "_unindexed")
+	assert.Contains(t, vertices[id2.String()].Properties, "_unindexed")
+	assert.Contains(t, vertices[id3.String()].Properties, "_dangling")
+	assert.Equal(t, "virtual_network", vertices[id3.String()].Label)
+	assert.Equal(t, "virtual_network", vertices[id4.String()].Label)
+	assert.Contains(t, vertices[id4.String()].Properties, "_incomplete")
+	assert.Contains(t, vertices[id4.String()].Properties, "_inferred")
+	assert.Contains(t, vertices[id4.String()].Properties, "fq_name")
+
+	assert.Equal(t, 4, d.stats.Types["virtual_network"])
+	assert.Equal(t, 3, d.stats.Incomplete)
+	assert.Equal(t, 3, d.stats.IncompleteReasons["no_id_perms"])
+	assert.Equal(t, 1, d.stats.IncompleteReasons["no_type"])
+	assert.Equal(t, 1, d.stats.IncompleteReasons["no_fq_name"])
+	assert.Equal(t, 1, d.stats.Missing)
+	assert.Equal(t, 1, d.stats.MissingReasons["dangling"])
+	assert.Equal(t, 4, d.stats.Written)
+}
+
+func TestCSVDumpConflicts(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	resources := strings.Join([]string{
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id1.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""vn1""]"`, csvBlob(id1.String()), csvBlob("fq_name")),
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id2.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""vn2""]"`, csvBlob(id2.String()), csvBlob("fq_name")),
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id3.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""vn2""]"`, csvBlob(id3.String()), csvBlob("fq_name")),
+	}, "\n")
+	entries := strings.Join([]string{
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn1:"+id1.String())),
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn1-old:"+id1.String())),
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn2:"+id2.String())),
+		fmt.Sprintf(`%s,%s,null`, csvBlob("virtual_network"), csvBlob("vn2:"+id3.String())),
+	}, "\n")
+
+	var output bytes.Buffer
+	d := NewCSVDump(strings.NewReader(resources), strings.NewReader(entries), &output)
+	d.Start()
+
+	vertices := readDump(t, &output)
+	assert.Equal(t, 3, len(vertices))
+	for _, id := range []uuid.UUID{id1, id2, id3} {
+		assert.Contains(t, vertices[id.String()].Properties, "_conflict")
+	}
+	assert.Equal(t, 2, len(vertices[id1.String()].Properties["_fq_names"]))
+	assert.Equal(t, 1, len(vertices[id2.String()].Properties["_fq_name_uuids"]))
+
+	conflicts := d.index.conflicts()
+	assert.Equal(t, 1, len(conflicts.UUIDs))
+	assert.Equal(t, id1, conflicts.UUIDs[0].UUID)
+	assert.Equal(t, 1, len(conflicts.FQNames))
+	assert.Equal(t, "virtual_network:vn2", conflicts.FQNames[0].FQName)
+	assert.Equal(t, 2, len(conflicts.FQNames[0].UUIDs))
+}
+
+func TestIncrementalDump(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	id4, _ := uuid.NewV4()
+	id5, _ := uuid.NewV4()
+	id6, _ := uuid.NewV4()
+	lastModifiedProp := func(v *g.Vertex, lastModified string) {
+		t, _ := utils.ParseContrailTime(lastModified)
+		v.AddSingleProperty("updated", t.Unix())
+		v.AddSingleProperty("id_perms", map[string]interface{}{"last_modified": lastModified})
+	}
+
+	// id1 refs id2, id3 has been removed since the base dump
+	var base bytes.Buffer
+	backend := g.NewGsonBackend(&base)
+	backend.Start()
+	v1 := g.Vertex{ID: id1, Label: "virtual_machine_interface"}
+	lastModifiedProp(&v1, "2018-01-01T00:00:00.000000")
+	v1.AddOutEdge(g.Edge{Label: "ref", InV: id2, InVLabel: "virtual_network"})
+	v2 := g.Vertex{ID: id2, Label: "virtual_network"}
+	lastModifiedProp(&v2, "2018-01-01T00:00:00.000000")
+	v2.AddInEdge(g.Edge{Label: "ref", OutV: id1, OutVLabel: "virtual_machine_interface"})
+	v3 := g.Vertex{ID: id3, Label: "virtual_network"}
+	lastModifiedProp(&v3, "2018-01-01T00:01:40.000000")
+	v5 := g.Vertex{ID: id5, Label: "project"}
+	lastModifiedProp(&v5, "2018-01-01T00:00:00.000000")
+	v6 := g.Vertex{ID: id6, Label: "project"}
+	lastModifiedProp(&v6, "2018-01-01T00:00:00.250000")
+	backend.Create(v1)
+	backend.Create(v2)
+	backend.Create(v3)
+	backend.Create(v5)
+	backend.Create(v6)
+	backend.Stop()
+
+	// id2 has been modified and id4 added. id5 has been modified
+	// before the most recent resource of the base dump was read.
+	// id6 has been modified in the same second as its base version.
+	entries := [][]string{
+		{"virtual_machine_interface", "vmi1:" + id1.String()},
+		{"virtual_network", "vn2:" + id2.String()},
+		{"virtual_network", "vn4:" + id4.String()},
+		{"project", "project5:" + id5.String()},
+		{"project", "project6:" + id6.String()},
+	}
+	i := 0
+	it := &gockle.IteratorMock{}
+	it.When("Scan", mock.Any).Call(func(results []interface{}) bool {
+		if i >= len(entries) {
+			return false
+		}
+		*results[0].(*string) = entries[i][0]
+		*results[1].(*string) = entries[i][1]
+		i++
+		return true
+	})
+	it.When("Close").Return(nil)
+
+	lastModified := "SELECT value FROM obj_uuid_table WHERE key=? AND column1=?"
+	resource := "SELECT key, column1, value FROM obj_uuid_table WHERE key=?"
+	session := &gockle.SessionMock{}
+	session.When("ScanIterator", "SELECT key, column1 FROM obj_fq_name_table", []interface{}(nil)).Return(it)
+	session.When("ScanMapSlice", lastModified, []interface{}{id1.String(), "prop:id_perms"}).Return(
+		[]map[string]interface{}{{"value": `{"last_modified": "2018-01-01T00:00:00.000000"}`}}, nil)
+	session.When("ScanMapSlice", lastModified, []interface{}{id2.String(), "prop:id_perms"}).Return(
+		[]map[string]interface{}{{"value": `{"last_modified": "2018-01-01T00:10:00.000000"}`}}, nil)
+	session.When("ScanMapSlice", resource, []interface{}{id2.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"virtual_network"`},
+			{"column1": []byte("fq_name"), "value": `["vn2"]`},
+			{"column1": []byte("backref:virtual_machine_interface:" + id1.String()), "value": `{"attr": null}`},
+		}, nil)
+	session.When("ScanMapSlice", lastModified, []interface{}{id5.String(), "prop:id_perms"}).Return(
+		[]map[string]interface{}{{"value": `{"last_modified": "2018-01-01T00:01:00.000000"}`}}, nil)
+	session.When("ScanMapSlice", resource, []interface{}{id5.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"project"`},
+			{"column1": []byte("fq_name"), "value": `["project5"]`},
+		}, nil)
+	session.When("ScanMapSlice", lastModified, []interface{}{id6.String(), "prop:id_perms"}).Return(
+		[]map[string]interface{}{{"value": `{"last_modified": "2018-01-01T00:00:00.750000"}`}}, nil)
+	session.When("ScanMapSlice", resource, []interface{}{id6.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"project"`},
+			{"column1": []byte("fq_name"), "value": `["project6"]`},
+		}, nil)
+	session.When("ScanMapSlice", resource, []interface{}{id4.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"virtual_network"`},
+			{"column1": []byte("fq_name"), "value": `["vn4"]`},
+		}, nil)
+
+	var output bytes.Buffer
+	d, err := NewIncrementalDump(session, &base, &output)
+	assert.Nil(t, err)
+	d.Start()
+
+	vertices := readDump(t, &output)
+	assert.Equal(t, 5, len(vertices))
+	assert.NotContains(t, vertices, id3.String())
+	assert.NotContains(t, vertices[id1.String()].Properties, "fq_name")
+	assert.Contains(t, vertices[id5.String()].Properties, "fq_name")
+	assert.Contains(t, vertices[id6.String()].Properties, "fq_name")
+	assert.Contains(t, vertices[id4.String()].Properties, "fq_name")
+	assert.Equal(t, 1, len(vertices[id1.String()].OutE["ref"]))
+	assert.Equal(t, 1, len(vertices[id2.String()].InE["ref"]))
+	assert.Contains(t, vertices[id2.String()].Properties, "fq_name")
+}
+
+func TestResumeDump(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	resources := strings.Join([]string{
+		fmt.Sprintf(`%s,%s,"""virtual_machine_interface"""`, csvBlob(id1.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"{""attr"": null}"`, csvBlob(id1.String()), csvBlob("ref:virtual_network:"+id3.String())),
+		fmt.Sprintf(`%s,%s,"""virtual_network"""`, csvBlob(id2.String()), csvBlob("type")),
+	}, "\n")
+
+	// interrupted dump, only the first resource is kept
+	var first bytes.Buffer
+	var checkpoint g.GsonCheckpoint
+	d := NewCSVDump(strings.NewReader(resources), nil, &first)
+	d.backend.SetCheckpoint(1, func(c g.GsonCheckpoint) {
+		if c.Vertices == 1 {
+			checkpoint = c
+		}
+	})
+	d.Start()
+	first.Truncate(int(checkpoint.Offset))
+
+	var output bytes.Buffer
+	d = NewCSVDump(strings.NewReader(resources), nil, &output)
+	err := d.Resume(bytes.NewReader(first.Bytes()), checkpoint)
+	assert.Nil(t, err)
+	d.Start()
+
+	first.Write(output.Bytes())
+	assert.Equal(t, 3, bytes.Count(first.Bytes(), []byte("\n")))
+	vertices := readDump(t, &first)
+	assert.Equal(t, 3, len(vertices))
+	assert.Equal(t, "virtual_machine_interface", vertices[id1.String()].Label)
+	assert.Equal(t, "virtual_network", vertices[id2.String()].Label)
+	assert.Equal(t, "virtual_network", vertices[id3.String()].Label)
+	assert.Contains(t, vertices[id3.String()].Properties, "_missing")
+	assert.Equal(t, 1, len(vertices[id3.String()].InE["ref"]))
+	assert.Equal(t, 1, d.stats.Resumed)
+	assert.Equal(t, 1, d.stats.MissingReasons["referenced"])
+	assert.Equal(t, 2, d.stats.Types["virtual_network"])
+}
+
+func clusterSession(entries [][]string, resources map[uuid.UUID][]map[string]interface{}) *gockle.SessionMock {
+	i := 0
+	it := &gockle.IteratorMock{}
+	it.When("Scan", mock.Any).Call(func(results []interface{}) bool {
+		if i >= len(entries) {
+			return false
+		}
+		*results[0].(*string) = entries[i][0]
+		*results[1].(*string) = entries[i][1]
+		i++
+		return true
+	})
+	it.When("Close").Return(nil)
+
+	j := 0
+	uuids := &gockle.IteratorMock{}
+	uuids.When("Scan", mock.Any).Call(func(results []interface{}) bool {
+		if j >= len(entries) {
+			return false
+		}
+		*results[0].(*string) = entries[j][1]
+		j++
+		return true
+	})
+	uuids.When("Close").Return(nil)
+
+	resource := "SELECT key, column1, value FROM obj_uuid_table WHERE key=?"
+	session := &gockle.SessionMock{}
+	session.When("ScanIterator", "SELECT key, column1 FROM obj_fq_name_table", []interface{}(nil)).Return(it)
+	session.When("ScanIterator", "SELECT column1 FROM obj_fq_name_table", []interface{}(nil)).Return(uuids)
+	for id, rows := range resources {
+		session.When("ScanMapSlice", resource, []interface{}{id.String()}).Return(rows, nil)
+	}
+	return session
+}
+
+func TestMultiClusterDump(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	id4, _ := uuid.NewV4()
+	id5, _ := uuid.NewV4()
+	id6, _ := uuid.NewV4()
+
+	// id1 refs id2 and the missing id5 in the first cluster,
+	// id3 is in both clusters and id4 refs id3 in the second one.
+	// id1 also refs id6 which is only a resource of the second one.
+	s1 := clusterSession([][]string{
+		{"virtual_machine_interface", "vmi1:" + id1.String()},
+		{"virtual_network", "vn2:" + id2.String()},
+		{"route_target", "target:64512:1:" + id3.String()},
+	}, map[uuid.UUID][]map[string]interface{}{
+		id1: {
+			{"column1": []byte("type"), "value": `"virtual_machine_interface"`},
+			{"column1": []byte("fq_name"), "value": `["vmi1"]`},
+			{"column1": []byte("ref:virtual_network:" + id2.String()), "value": `{"attr": null}`},
+			{"column1": []byte("ref:security_group:" + id5.String()), "value": `{"attr": null}`},
+			{"column1": []byte("ref:virtual_network:" + id6.String()), "value": `{"attr": null}`},
+		},
+		id2: {
+			{"column1": []byte("type"), "value": `"virtual_network"`},
+			{"column1": []byte("fq_name"), "value": `["vn2"]`},
+			{"column1": []byte("backref:virtual_machine_interface:" + id1.String()), "value": `{"attr": null}`},
+		},
+		id3: {
+			{"column1": []byte("type"), "value": `"route_target"`},
+			{"column1": []byte("fq_name"), "value": `["target:64512:1"]`},
+		},
+	})
+	s2 := clusterSession([][]string{
+		{"route_target", "target:64512:1:" + id3.String()},
+		{"routing_instance", "ri4:" + id4.String()},
+		{"virtual_network", "vn6:" + id6.String()},
+	}, map[uuid.UUID][]map[string]interface{}{
+		id3: {
+			{"column1": []byte("type"), "value": `"route_target"`},
+			{"column1": []byte("fq_name"), "value": `["target:64512:1"]`},
+		},
+		id4: {
+			{"column1": []byte("type"), "value": `"routing_instance"`},
+			{"column1": []byte("fq_name"), "value": `["ri4"]`},
+			{"column1": []byte("ref:route_target:" + id3.String()), "value": `{"attr": null}`},
+		},
+		id6: {
+			{"column1": []byte("type"), "value": `"virtual_network"`},
+			{"column1": []byte("fq_name"), "value": `["vn6"]`},
+		},
+	})
+
+	var output bytes.Buffer
+	d := NewMultiClusterDump([]*Cluster{
+		{Name: "region1", Session: s1},
+		{Name: "region2", Session: s2},
+	}, &output, 0, false)
+	d.Start()
+
+	result, err := g.ValidateGson(bytes.NewReader(output.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(result.Errors))
+
+	vertices := readDump(t, &output)
+	assert.Equal(t, 6, len(vertices))
+	for id, cluster := range map[uuid.UUID]string{id1: "region1", id2: "region1", id3: "region1", id4: "region2", id5: "region1", id6: "region2"} {
+		value := vertices[id.String()].Properties["cluster"][0].(map[string]interface{})
+		assert.Equal(t, cluster, value["value"])
+	}
+	// the edges between the clusters are not written
+	assert.Equal(t, 0, len(vertices[id4.String()].OutE))
+	assert.Equal(t, 0, len(vertices[id3.String()].InE))
+	assert.Equal(t, 0, len(vertices[id6.String()].InE))
+	assert.Equal(t, 2, len(vertices[id1.String()].OutE["ref"]))
+	assert.NotContains(t, vertices[id6.String()].Properties, "_missing")
+	assert.Equal(t, 1, d.stats.Shared)
+	assert.Equal(t, 2, d.stats.CrossClusterEdges)
+	assert.Equal(t, 0, d.stats.Duplicates)
+	shared := d.shared.shared()
+	assert.Equal(t, 1, len(shared))
+	assert.Equal(t, id3, shared[0].UUID)
+	assert.Equal(t, []string{"region1", "region2"}, shared[0].Clusters)
+}
+
+func TestParseClusters(t *testing.T) {
+	configs, err := parseClusters([]string{"region1=10.0.0.1,10.0.0.2", "region2=10.0.1.1", "10.0.1.2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []clusterConfig{
+		{name: "region1", hosts: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "region2", hosts: []string{"10.0.1.1", "10.0.1.2"}},
+	}, configs)
+
+	_, err = parseClusters([]string{"10.0.0.1"})
+	assert.NotNil(t, err)
+	_, err = parseClusters([]string{"region1=10.0.0.1", "region1=10.0.0.2"})
+	assert.NotNil(t, err)
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gremlin-dump")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRotation(dir, 2, false)
+	r.now = func() time.Time { return now }
+	dump := func(output io.Writer, path string) error {
+		ioutil.WriteFile(path+".stats.json", []byte("{}"), 0644)
+		_, err := output.Write([]byte(path))
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, r.run(dump))
+		now = now.Add(time.Hour)
+	}
+
+	names, err := r.dumps()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dump-20180101T010000Z.json", "dump-20180101T020000Z.json"}, names)
+	_, err = os.Stat(filepath.Join(dir, "dump-20180101T000000Z.json.stats.json"))
+	assert.True(t, os.IsNotExist(err))
+	latest, err := os.Readlink(filepath.Join(dir, "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, "dump-20180101T020000Z.json", latest)
+
+	// a failed dump is not kept and doesn't change latest
+	assert.NotNil(t, r.run(func(output io.Writer, path string) error {
+		return fmt.Errorf("failed")
+	}))
+	names, _ = r.dumps()
+	assert.Equal(t, 2, len(names))
+	latest, _ = os.Readlink(filepath.Join(dir, "latest"))
+	assert.Equal(t, "dump-20180101T020000Z.json", latest)
+	assert.Equal(t, 1, r.status.Failures)
+	assert.Equal(t, "dump-20180101T020000Z.json", r.status.LastDump)
+	assert.Equal(t, time.Date(2018, 1, 1, 2, 0, 0, 0, time.UTC), r.status.LastSuccess)
+	_, err = os.Stat(filepath.Join(dir, "status.json"))
+	assert.Nil(t, err)
+}
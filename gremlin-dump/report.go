@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+type malformedResource struct {
+	UUID      uuid.UUID            `json:"uuid"`
+	Type      string               `json:"type"`
+	Malformed []utils.Malformation `json:"malformed"`
+}
+
+// malformedReport collects the resources that have malformed columns
+type malformedReport struct {
+	Resources int                 `json:"resources"`
+	Columns   int                 `json:"columns"`
+	Kinds     map[string]int      `json:"kinds"`
+	Details   []malformedResource `json:"details"`
+	mutex     sync.Mutex
+}
+
+func newMalformedReport() *malformedReport {
+	return &malformedReport{
+		Kinds:   make(map[string]int),
+		Details: make([]malformedResource, 0),
+	}
+}
+
+func (r *malformedReport) add(v g.Vertex) {
+	ms := utils.Malformations(v)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Resources++
+	r.Columns += len(ms)
+	for _, m := range ms {
+		r.Kinds[m.Kind]++
+	}
+	r.Details = append(r.Details, malformedResource{
+		UUID:      v.ID,
+		Type:      v.Label,
+		Malformed: ms,
+	})
+}
+
+func (r *malformedReport) write(path string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return writeJSONReport(path, r)
+}
+
+func writeJSONReport(path string, report interface{}) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	rotationPrefix     = "dump-"
+	rotationTimeFormat = "20060102T150405Z"
+	rotationLatest     = "latest"
+	rotationStatusFile = "status.json"
+)
+
+// rotationStatus is written after each dump of the
+// rotation mode so that dumps can be monitored
+type rotationStatus struct {
+	LastAttempt  time.Time `json:"last_attempt"`
+	LastSuccess  time.Time `json:"last_success"`
+	LastDuration float64   `json:"last_duration"`
+	LastDump     string    `json:"last_dump"`
+	LastError    string    `json:"last_error,omitempty"`
+	Failures     int       `json:"failures"`
+}
+
+// rotation writes timestamped dumps in dir and only keeps the
+// last keep dumps. The latest symlink points to the last dump.
+type rotation struct {
+	dir      string
+	keep     int
+	compress bool
+	status   rotationStatus
+	now      func() time.Time
+}
+
+func newRotation(dir string, keep int, compress bool) *rotation {
+	return &rotation{
+		dir:      dir,
+		keep:     keep,
+		compress: compress,
+		now:      time.Now,
+	}
+}
+
+func (r *rotation) dumpName(t time.Time) string {
+	name := rotationPrefix + t.UTC().Format(rotationTimeFormat) + ".json"
+	if r.compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// loop runs dump every interval, the first time right away
+func (r *rotation) loop(every time.Duration, dump func(io.Writer, string) error) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := r.run(dump); err != nil {
+			log.Errorf("Dump failed: %s", err)
+		}
+		<-ticker.C
+	}
+}
+
+// run writes a new dump with the dump function, which is given the
+// output and the final path of the dump. The dump is written to a
+// temporary file that is renamed when the dump is successful.
+func (r *rotation) run(dump func(io.Writer, string) error) error {
+	start := r.now()
+	r.status.LastAttempt = start
+	err := r.write(start, dump)
+	if err != nil {
+		r.status.LastError = err.Error()
+		r.status.Failures++
+	} else {
+		r.status.LastSuccess = start
+		r.status.LastDuration = r.now().Sub(start).Seconds()
+		r.status.LastDump = r.dumpName(start)
+		r.status.LastError = ""
+		r.status.Failures = 0
+	}
+	if err := r.writeStatus(); err != nil {
+		log.Errorf("Failed to write status: %s", err)
+	}
+	return err
+}
+
+func (r *rotation) write(start time.Time, dump func(io.Writer, string) error) error {
+	name := r.dumpName(start)
+	path := filepath.Join(r.dir, name)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = r.dumpTo(f, path, dump)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := r.updateLatest(name); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+func (r *rotation) dumpTo(f *os.File, path string, dump func(io.Writer, string) error) error {
+	if !r.compress {
+		return dump(f, path)
+	}
+	w := gzip.NewWriter(f)
+	if err := dump(w, path); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// updateLatest atomically replaces the latest symlink
+func (r *rotation) updateLatest(name string) error {
+	latest := filepath.Join(r.dir, rotationLatest)
+	tmp := latest + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, latest)
+}
+
+// dumps lists the dumps of the rotation, oldest first
+func (r *rotation) dumps() ([]string, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, rotationPrefix) &&
+			(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")) &&
+			!strings.HasSuffix(name, ".stats.json") {
+			names = append(names, name)
+		}
+	}
+	// the timestamp format sorts chronologically
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune removes the oldest dumps and their stats
+// so that only the last keep dumps remain
+func (r *rotation) prune() error {
+	names, err := r.dumps()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-r.keep; i++ {
+		path := filepath.Join(r.dir, names[i])
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		os.Remove(path + ".stats.json")
+		log.Noticef("Removed old dump %s", path)
+	}
+	return nil
+}
+
+// writeStatus atomically replaces the status file
+func (r *rotation) writeStatus() error {
+	data, err := json.MarshalIndent(r.status, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.dir, rotationStatusFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// dumpStats is the summary of a dump, written
+// to a JSON file when the dump is done
+type dumpStats struct {
+	Start             time.Time      `json:"start"`
+	Duration          float64        `json:"duration"`
+	Throughput        float64        `json:"throughput"`
+	Read              int            `json:"read"`
+	Written           int            `json:"written"`
+	Duplicates        int            `json:"duplicates"`
+	Types             map[string]int `json:"types"`
+	Incomplete        int            `json:"incomplete"`
+	IncompleteReasons map[string]int `json:"incomplete_reasons"`
+	Missing           int            `json:"missing"`
+	MissingReasons    map[string]int `json:"missing_reasons"`
+	Malformed         int            `json:"malformed"`
+	Unindexed         int            `json:"unindexed"`
+	Conflicts         int            `json:"conflicts"`
+	Reused            int            `json:"reused"`
+	Resumed           int            `json:"resumed"`
+	Shared            int            `json:"shared"`
+	CrossClusterEdges int            `json:"cross_cluster_edges"`
+	mutex             sync.Mutex
+}
+
+func newDumpStats() *dumpStats {
+	return &dumpStats{
+		Types:             make(map[string]int),
+		IncompleteReasons: make(map[string]int),
+		MissingReasons:    make(map[string]int),
+	}
+}
+
+// count records a report event
+func (s *dumpStats) count(event int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch event {
+	case DumpStart:
+		s.Start = time.Now()
+	case ResourceRead:
+		s.Read++
+	case ResourceWrite:
+		s.Written++
+	case DuplicateVertex:
+		s.Duplicates++
+	case UnindexedVertex:
+		s.Unindexed++
+	case DanglingEntry:
+		s.Missing++
+		s.MissingReasons["dangling"]++
+	case MalformedVertex:
+		s.Malformed++
+	case ConflictVertex:
+		s.Conflicts++
+	case ReusedVertex:
+		s.Reused++
+	case ResumedVertex:
+		s.Resumed++
+	case SharedVertex:
+		s.Shared++
+	case CrossClusterEdge:
+		s.CrossClusterEdges++
+	}
+}
+
+// addVertex records the type of a written resource or dangling
+// entry and the reasons why it is incomplete
+func (s *dumpStats) addVertex(v g.Vertex) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Types[v.Label]++
+	if !v.HasProp("_incomplete") {
+		return
+	}
+	inferred := make(map[string]bool)
+	for _, p := range v.Properties["_inferred"] {
+		if name, ok := p.Value.(string); ok {
+			inferred[name] = true
+		}
+	}
+	s.Incomplete++
+	if v.Label == "_incomplete" || inferred["type"] {
+		s.IncompleteReasons["no_type"]++
+	}
+	if !v.HasProp("fq_name") || inferred["fq_name"] {
+		s.IncompleteReasons["no_fq_name"]++
+	}
+	if !v.HasProp("id_perms") {
+		s.IncompleteReasons["no_id_perms"]++
+	}
+}
+
+// finish records the missing resources written by the backend
+// and computes the duration and throughput of the dump
+func (s *dumpStats) finish(duration time.Duration, referenced map[string]int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for label, count := range referenced {
+		s.Types[label] += count
+		s.Missing += count
+		s.MissingReasons["referenced"] += count
+	}
+	s.Duration = duration.Seconds()
+	if s.Duration > 0 {
+		s.Throughput = float64(s.Written) / s.Duration
+	}
+}
+
+func (s *dumpStats) progress() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("read:%d write:%d dup:%d unindexed:%d dangling:%d malformed:%d conflicts:%d reused:%d resumed:%d",
+		s.Read, s.Written, s.Duplicates, s.Unindexed, s.MissingReasons["dangling"], s.Malformed,
+		s.Conflicts, s.Reused, s.Resumed)
+}
+
+func (s *dumpStats) write(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return writeJSONReport(path, s)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/eonpatapon/gremlin"
+	cli "github.com/jawher/mow.cli"
+	logging "github.com/op/go-logging"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+var (
+	log = logging.MustGetLogger("gremlin-load")
+)
+
+const (
+	// BatchSize default number of vertices or edges sent in one request
+	BatchSize = 50
+	// MaxBatchBytes keeps requests under the gremlin-server maxContentLength
+	MaxBatchBytes = 48 * 1024
+)
+
+const (
+	LoadStart = iota
+	VertexLoad
+	EdgeLoad
+	LoadEnd
+)
+
+// upsertVertices creates or replaces the properties of each vertex
+const upsertVertices = `_vertices.each { v ->
+	def vertex = g.V(v.id).tryNext().orElseGet { g.addV(v.label).property(id, v.id).next() }
+	vertex.properties().each { it.remove() }
+	v.properties.each { name, values ->
+		values.each { value ->
+			if (values.size() > 1) {
+				vertex.property(list, name, value)
+			} else {
+				vertex.property(name, value)
+			}
+		}
+	}
+}`
+
+// upsertEdges creates or replaces the properties of each edge
+const upsertEdges = `_edges.each { e ->
+	def edge = g.V(e.outV).outE(e.label).where(inV().hasId(e.inV)).tryNext().orElseGet {
+		g.V(e.outV).as('o').V(e.inV).addE(e.label).from('o').next()
+	}
+	edge.properties().each { it.remove() }
+	e.properties.each { name, value -> edge.property(name, value) }
+}`
+
+// Load pushes a gremlin-dump file into a running gremlin-server
+type Load struct {
+	backend   *g.ServerBackend
+	batchSize int
+	report    chan int64
+	done      chan bool
+}
+
+// NewLoad returns a load process sending batchSize
+// vertices or edges per request to gremlinURI
+func NewLoad(gremlinURI string, batchSize int) Load {
+	return Load{
+		backend:   g.NewServerBackend(gremlinURI),
+		batchSize: batchSize,
+		report:    make(chan int64),
+		done:      make(chan bool),
+	}
+}
+
+// Start loads the dump. Vertices are loaded first so that both
+// ends of each edge exist when edges are loaded. Already existing
+// vertices and edges are updated. When clear is true the graph
+// is emptied before loading.
+func (l Load) Start(input io.ReadSeeker, clear bool) error {
+	l.backend.Start()
+	defer l.backend.Stop()
+	go l.reportCount()
+	defer func() {
+		l.report <- LoadEnd
+		<-l.done
+		fmt.Println()
+	}()
+
+	start := time.Now()
+	if clear {
+		log.Notice("Clearing graph...")
+		if _, err := l.backend.Send(gremlin.Query(`g.V().drop().iterate()`)); err != nil {
+			return fmt.Errorf("failed to clear graph: %s", err)
+		}
+	}
+	l.report <- LoadStart
+
+	vertices, err := l.loadVertices(input)
+	if err != nil {
+		return err
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	edges, err := l.loadEdges(input)
+	if err != nil {
+		return err
+	}
+	log.Noticef("Load done in %0.2fs", time.Now().Sub(start).Seconds())
+
+	return l.verify(vertices, edges, clear)
+}
+
+func (l Load) reportCount() {
+	vertexCount := 0
+	edgeCount := 0
+	loadStatus := `W`
+
+	for c := range l.report {
+		switch c {
+		case VertexLoad:
+			vertexCount++
+		case EdgeLoad:
+			edgeCount++
+		case LoadStart:
+			loadStatus = `R`
+		case LoadEnd:
+			loadStatus = `D`
+		}
+		fmt.Printf("\rLoading [vertices:%d edges:%d] %s", vertexCount, edgeCount, loadStatus)
+		if c == LoadEnd {
+			l.done <- true
+			return
+		}
+	}
+}
+
+// readVertices calls fn for each vertex of the dump
+func readVertices(input io.Reader, fn func(g.Vertex) error) error {
+	r := bufio.NewReader(input)
+	lineNumber := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		lineNumber++
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			vertex, err := g.ReadGsonVertex(line)
+			if err != nil {
+				return fmt.Errorf("invalid vertex at line %d: %s", lineNumber, err)
+			}
+			if err := fn(vertex); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (l Load) loadVertices(input io.Reader) (int, error) {
+	count := 0
+	b := newBatch("_vertices", upsertVertices, l.batchSize, l.backend)
+	err := readVertices(input, func(v g.Vertex) error {
+		count++
+		l.report <- VertexLoad
+		return b.add(vertexItem(v))
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, b.flush()
+}
+
+// loadEdges loads the edges of the dump. Each edge is
+// present on both of its vertices but is only sent once.
+func (l Load) loadEdges(input io.Reader) (int, error) {
+	seen := make(map[string]bool)
+	b := newBatch("_edges", upsertEdges, l.batchSize, l.backend)
+	add := func(e g.Edge) error {
+		key := e.OutV.String() + "-" + e.InV.String() + "-" + e.Label
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		l.report <- EdgeLoad
+		return b.add(edgeItem(e))
+	}
+	err := readVertices(input, func(v g.Vertex) error {
+		for _, edges := range v.OutE {
+			for _, e := range edges {
+				e.OutV = v.ID
+				if err := add(e); err != nil {
+					return err
+				}
+			}
+		}
+		for _, edges := range v.InE {
+			for _, e := range edges {
+				e.InV = v.ID
+				if err := add(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return len(seen), err
+	}
+	return len(seen), b.flush()
+}
+
+// verify compares the number of vertices and edges in the
+// server with the dump. Without clear, the graph can
+// contain more elements than the dump.
+func (l Load) verify(vertices int, edges int, clear bool) error {
+	serverVertices, err := l.count(`g.V().count()`)
+	if err != nil {
+		return err
+	}
+	serverEdges, err := l.count(`g.E().count()`)
+	if err != nil {
+		return err
+	}
+	log.Noticef("Dump has %d vertices and %d edges, server has %d vertices and %d edges",
+		vertices, edges, serverVertices, serverEdges)
+	if serverVertices < vertices || serverEdges < edges ||
+		(clear && (serverVertices != vertices || serverEdges != edges)) {
+		return fmt.Errorf("server counts don't match the dump")
+	}
+	return nil
+}
+
+func (l Load) count(query string) (int, error) {
+	data, err := l.backend.Send(gremlin.Query(query))
+	if err != nil {
+		return 0, err
+	}
+	var counts []int
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return 0, err
+	}
+	if len(counts) != 1 {
+		return 0, fmt.Errorf("unexpected count result %s", data)
+	}
+	return counts[0], nil
+}
+
+func vertexItem(v g.Vertex) map[string]interface{} {
+	props := make(map[string][]interface{})
+	for name, values := range v.Properties {
+		for _, p := range values {
+			props[name] = append(props[name], p.Value)
+		}
+	}
+	return map[string]interface{}{
+		"id":         v.ID.String(),
+		"label":      v.Label,
+		"properties": props,
+	}
+}
+
+func edgeItem(e g.Edge) map[string]interface{} {
+	props := make(map[string]interface{})
+	for name, p := range e.Properties {
+		// gremlin does not allow null values in edge properties
+		if p.Value != nil {
+			props[name] = p.Value
+		}
+	}
+	return map[string]interface{}{
+		"outV":       e.OutV.String(),
+		"inV":        e.InV.String(),
+		"label":      e.Label,
+		"properties": props,
+	}
+}
+
+type sender interface {
+	Send(*gremlin.Request) ([]byte, error)
+}
+
+// batch groups items sent as a list in the binding of a query
+type batch struct {
+	binding string
+	query   string
+	size    int
+	items   []interface{}
+	bytes   int
+	backend sender
+}
+
+func newBatch(binding string, query string, size int, backend sender) *batch {
+	return &batch{
+		binding: binding,
+		query:   query,
+		size:    size,
+		backend: backend,
+	}
+}
+
+// add queues the item and sends the batch when it is full
+// or when it would exceed the maximum request size
+func (b *batch) add(item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if len(b.items) > 0 && b.bytes+len(data) > MaxBatchBytes {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.items = append(b.items, item)
+	b.bytes += len(data)
+	if len(b.items) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batch) flush() error {
+	if len(b.items) == 0 {
+		return nil
+	}
+	_, err := b.backend.Send(gremlin.Query(b.query).Bindings(gremlin.Bind{
+		b.binding: b.items,
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to load batch: %s", err)
+	}
+	b.items = nil
+	b.bytes = 0
+	return nil
+}
+
+func setup(gremlinURI string, filePath string, batchSize int, clear bool) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		log.Fatalf("Failed to open file %s: %s", filePath, err)
+	}
+	defer f.Close()
+
+	l := NewLoad(gremlinURI, batchSize)
+	if err := l.Start(f, clear); err != nil {
+		log.Fatalf("Load failed: %s", err)
+	}
+}
+
+func main() {
+	app := cli.App(os.Args[0], "Load a gremlin-dump file in gremlin-server")
+	gremlinSrv := app.String(cli.StringOpt{
+		Name:   "gremlin",
+		Value:  "localhost:8182",
+		Desc:   "host:port of gremlin server",
+		EnvVar: "GREMLIN_LOAD_GREMLIN_SERVER",
+	})
+	batchSize := app.Int(cli.IntOpt{
+		Name:   "batch-size",
+		Value:  BatchSize,
+		Desc:   "number of vertices or edges sent in one request",
+		EnvVar: "GREMLIN_LOAD_BATCH_SIZE",
+	})
+	clear := app.Bool(cli.BoolOpt{
+		Name:   "clear",
+		Value:  false,
+		Desc:   "remove all vertices and edges before loading",
+		EnvVar: "GREMLIN_LOAD_CLEAR",
+	})
+	filePath := app.String(cli.StringArg{
+		Name: "SRC",
+		Desc: "gremlin-dump file path",
+	})
+	utils.SetupLogging(app, log)
+	app.Action = func() {
+		if *batchSize < 1 {
+			log.Fatal("--batch-size must be at least 1")
+		}
+		gremlinURI := fmt.Sprintf("ws://%s/gremlin", *gremlinSrv)
+		setup(gremlinURI, *filePath, *batchSize, *clear)
+	}
+	app.Run(os.Args)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/eonpatapon/gremlin"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/testutils"
+)
+
+var gremlinURI = "ws://localhost:8182/gremlin"
+
+func TestMain(m *testing.M) {
+	cmd := testutils.StartGremlinServer("gremlin-contrail.yml")
+	res := m.Run()
+	testutils.StopGremlinServer(cmd)
+	os.Exit(res)
+}
+
+type recordSender struct {
+	requests []*gremlin.Request
+}
+
+func (s *recordSender) Send(r *gremlin.Request) ([]byte, error) {
+	s.requests = append(s.requests, r)
+	return nil, nil
+}
+
+func TestBatch(t *testing.T) {
+	s := &recordSender{}
+	b := newBatch("_items", "query", 2, s)
+	for i := 0; i < 3; i++ {
+		b.add(i)
+	}
+	assert.Equal(t, 1, len(s.requests))
+	b.flush()
+	assert.Equal(t, 2, len(s.requests))
+	assert.Equal(t, []interface{}{2}, s.requests[1].Args.Bindings["_items"])
+
+	// large items are sent in smaller batches
+	s = &recordSender{}
+	b = newBatch("_items", "query", 10, s)
+	item := strings.Repeat("a", MaxBatchBytes/3)
+	for i := 0; i < 3; i++ {
+		b.add(item)
+	}
+	b.flush()
+	assert.Equal(t, 2, len(s.requests))
+}
+
+func dump(vertices ...g.Vertex) *bytes.Reader {
+	var output bytes.Buffer
+	backend := g.NewGsonBackend(&output)
+	backend.Start()
+	for _, v := range vertices {
+		backend.Create(v)
+	}
+	backend.Stop()
+	return bytes.NewReader(output.Bytes())
+}
+
+func TestLoad(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := g.Vertex{ID: id1, Label: "virtual_machine_interface"}
+	v1.AddProperty("fq_name", []interface{}{"vmi1"})
+	e := g.Edge{Label: "ref", InV: id2, InVLabel: "virtual_network"}
+	e.AddProperty("attr", map[string]interface{}{"foo": "bar"})
+	v1.AddOutEdge(e)
+	// id2 is written as a _missing vertex
+
+	l := NewLoad(gremlinURI, BatchSize)
+	err := l.Start(dump(v1), true)
+	assert.Nil(t, err)
+
+	l.backend.Start()
+	defer l.backend.Stop()
+	vertices, _ := l.count(`g.V().count()`)
+	edges, _ := l.count(`g.E().count()`)
+	assert.Equal(t, 2, vertices)
+	assert.Equal(t, 1, edges)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+const (
+	// EventHistory is the number of events kept to
+	// let consumers resume the stream
+	EventHistory = 10000
+	// EventBuffer is the number of events a consumer can lag
+	// behind before it is disconnected
+	EventBuffer = 1000
+)
+
+// Kinds of events
+const (
+	VertexCreated = "vertex_created"
+	VertexUpdated = "vertex_updated"
+	VertexDeleted = "vertex_deleted"
+	EdgeAdded     = "edge_added"
+	EdgeRemoved   = "edge_removed"
+)
+
+var (
+	// ErrEventsLost indicates that the events following
+	// the resumed one are not in the history anymore
+	ErrEventsLost = errors.New("events are not in the history anymore")
+	// ErrUnknownEvent indicates that the resumed event
+	// was not published by this gremlin-sync process
+	ErrUnknownEvent = errors.New("unknown event")
+)
+
+// Event is a mutation applied to the graph. Seq increases by
+// one for each event and is used to resume the stream. Epoch
+// identifies the gremlin-sync process, seq restarts at 1 with
+// a new epoch.
+type Event struct {
+	Epoch   int64     `json:"epoch"`
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Type    string    `json:"type"`
+	UUID    uuid.UUID `json:"uuid"`
+	FQName  []string  `json:"fq_name"`
+	Cluster string    `json:"cluster,omitempty"`
+	Fields  []string  `json:"fields,omitempty"`
+	Edge    *g.Edge   `json:"edge,omitempty"`
+}
+
+// eventStream keeps the last events and sends
+// new events to the subscribers
+type eventStream struct {
+	epoch       int64
+	seq         uint64
+	cluster     string
+	history     []Event
+	size        int
+	subscribers map[chan Event]bool
+	sync.Mutex
+}
+
+func newEventStream(size int) *eventStream {
+	return &eventStream{
+		epoch:       time.Now().UnixNano(),
+		history:     make([]Event, 0, size),
+		size:        size,
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+func (s *eventStream) publish(e Event) {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	e.Epoch = s.epoch
+	e.Seq = s.seq
+	e.Time = time.Now()
+	e.Cluster = s.cluster
+	if len(s.history) == s.size {
+		s.history = append(s.history[:0], s.history[1:]...)
+	}
+	s.history = append(s.history, e)
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		// the subscriber is too slow, it
+		// has to resume the stream
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events after since and a channel of the
+// following events. When since is 0, the whole history is returned.
+// The channel is closed when the subscriber doesn't keep up with
+// the stream.
+func (s *eventStream) subscribe(since uint64) ([]Event, chan Event, error) {
+	s.Lock()
+	defer s.Unlock()
+	if since > s.seq {
+		return nil, nil, ErrUnknownEvent
+	}
+	if since > 0 && len(s.history) > 0 && since+1 < s.history[0].Seq {
+		return nil, nil, ErrEventsLost
+	}
+	backlog := make([]Event, 0)
+	for _, e := range s.history {
+		if e.Seq > since {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, EventBuffer)
+	s.subscribers[ch] = true
+	return backlog, ch, nil
+}
+
+func (s *eventStream) unsubscribe(ch chan Event) {
+	s.Lock()
+	defer s.Unlock()
+	if s.subscribers[ch] {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// serveEvents streams events with Server-Sent Events. The stream
+// resumes after the Last-Event-ID header or the since parameter.
+// When the stream can't be resumed, because gremlin-sync has been
+// restarted or the consumer is too late, it replies with a 410 and
+// the consumer has to start over without an event id.
+func (s *eventStream) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var seq uint64
+	if since != "" {
+		epoch, n, err := parseEventID(since)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid event id %s", since), http.StatusBadRequest)
+			return
+		}
+		if epoch != s.epoch {
+			http.Error(w, fmt.Sprintf("event %s: %s, gremlin-sync was restarted", since, ErrUnknownEvent), http.StatusGone)
+			return
+		}
+		seq = n
+	}
+
+	backlog, ch, err := s.subscribe(seq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("event %s: %s", since, err), http.StatusGone)
+		return
+	}
+	defer s.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range backlog {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+	closed := r.Context().Done()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", eventID(e), e.Kind, data)
+}
+
+// eventID returns the id of an event in the stream,
+// made of its epoch and its sequence number
+func eventID(e Event) string {
+	return fmt.Sprintf("%d-%d", e.Epoch, e.Seq)
+}
+
+func parseEventID(id string) (int64, uint64, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid event id %s", id)
+	}
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return epoch, seq, nil
+}
+
+// deliver posts each event to the webhook url. A failed
+// delivery is retried until it succeeds, so that the
+// webhook receives all the events in order.
+func (s *eventStream) deliver(url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var seq uint64
+	for {
+		backlog, ch, err := s.subscribe(seq)
+		if err != nil {
+			log.Errorf("Webhook %s lost events after event %d: %s", url, seq, err)
+			seq = 0
+			continue
+		}
+		for _, e := range backlog {
+			postEvent(client, url, e)
+			seq = e.Seq
+		}
+		for e := range ch {
+			postEvent(client, url, e)
+			seq = e.Seq
+		}
+		log.Warningf("Webhook %s is lagging, resuming after event %d", url, seq)
+	}
+}
+
+func postEvent(client *http.Client, url string, e Event) {
+	data, _ := json.Marshal(e)
+	for {
+		r, err := client.Post(url, "application/json", bytes.NewReader(data))
+		if err == nil {
+			r.Body.Close()
+			if r.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %s", r.Status)
+		}
+		log.Errorf("Failed to deliver event %d to %s: %s", e.Seq, url, err)
+		time.Sleep(RetryDelay)
+	}
+}
+
+// changedFields returns the names of the properties that
+// differ between the old properties of a vertex in the graph
+// and the properties of its new version
+func changedFields(old map[string][]interface{}, props map[string][]g.Property) []string {
+	fields := make([]string, 0)
+	for name, values := range props {
+		newValues := make([]interface{}, len(values))
+		for i, p := range values {
+			newValues[i] = p.Value
+		}
+		if !reflect.DeepEqual(normalizeValue(old[name]), normalizeValue(newValues)) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range old {
+		if _, ok := props[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// normalizeValue converts value like it is when read from
+// gremlin-server so that values can be compared
+func normalizeValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
+
+// fqName returns the fq_name of a vertex from its
+// properties, read from gremlin-server or not
+func fqName(values []interface{}) []string {
+	names := make([]string, 0)
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			names = append(names, v)
+		case []string:
+			names = append(names, v...)
+		case []interface{}:
+			names = append(names, fqName(v)...)
+		}
+	}
+	return names
+}
+
+func vertexFQName(v g.Vertex) []string {
+	values := make([]interface{}, 0)
+	for _, p := range v.Properties["fq_name"] {
+		values = append(values, p.Value)
+	}
+	return fqName(values)
+}
+
+// EnableEvents publishes the mutations applied to the graph
+func (s *Sync) EnableEvents() {
+	s.events = newEventStream(EventHistory)
+	s.events.cluster = s.backend.Cluster()
+}
+
+// writeVertex creates or updates a vertex in the graph
+// and publishes the corresponding events
+func (s *Sync) writeVertex(v g.Vertex) error {
+	if s.events == nil {
+		return s.backend.UpdateVertex(v)
+	}
+	old, err := s.backend.VertexProperties(v.ID)
+	if err != nil {
+		return err
+	}
+	added, removed, err := s.backend.ApplyVertex(v)
+	if err != nil {
+		return err
+	}
+	e := Event{Type: v.Label, UUID: v.ID, FQName: vertexFQName(v)}
+	// a _missing vertex is created by an edge of another resource
+	if _, missing := old["_missing"]; old == nil || missing {
+		e.Kind = VertexCreated
+		s.events.publish(e)
+	} else if fields := changedFields(old, v.Properties); len(fields) > 0 {
+		e.Kind = VertexUpdated
+		e.Fields = fields
+		s.events.publish(e)
+	}
+	for _, edge := range added {
+		s.publishEdge(e, EdgeAdded, edge)
+	}
+	for _, edge := range removed {
+		s.publishEdge(e, EdgeRemoved, edge)
+	}
+	return nil
+}
+
+func (s *Sync) publishEdge(e Event, kind string, edge g.Edge) {
+	e.Kind = kind
+	e.Fields = nil
+	e.Edge = &edge
+	s.events.publish(e)
+}
+
+// markDeleted sets the deleted property of a vertex
+// and publishes the corresponding event
+func (s *Sync) markDeleted(v g.Vertex, t time.Time) error {
+	var old map[string][]interface{}
+	if s.events != nil {
+		var err error
+		if old, err = s.backend.VertexProperties(v.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.backend.UpdateVertexProperty(v, "deleted", t.Unix()); err != nil {
+		return err
+	}
+	if s.events != nil && old != nil {
+		s.events.publish(Event{Kind: VertexUpdated, Type: v.Label, UUID: v.ID,
+			FQName: fqName(old["fq_name"]), Fields: []string{"deleted"}})
+	}
+	return nil
+}
+
+// dropVertex deletes a vertex from the graph and
+// publishes the corresponding event
+func (s *Sync) dropVertex(v g.Vertex) error {
+	var old map[string][]interface{}
+	if s.events != nil {
+		var err error
+		if old, err = s.backend.VertexProperties(v.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.backend.DeleteVertex(v); err != nil {
+		return err
+	}
+	if s.events != nil && old != nil {
+		s.events.publish(Event{Kind: VertexDeleted, Type: v.Label, UUID: v.ID,
+			FQName: fqName(old["fq_name"])})
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// MaxPending default number of pending notifications
+// above which gremlin-sync is reported unhealthy
+const MaxPending = 10000
+
+// Health is the state of gremlin-sync reported by /healthz and /readyz
+type Health struct {
+	Rabbit        string     `json:"rabbit"`
+	Cassandra     string     `json:"cassandra"`
+	Gremlin       string     `json:"gremlin"`
+	Pending       int        `json:"pending"`
+	LastProcessed *time.Time `json:"last_processed"`
+	DeleteChecks  int64      `json:"delete_checks"`
+}
+
+func connectionState(connected bool) string {
+	if connected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// healthServer serves the health of the sync process. cassandra
+// is nil when resources are not read from cassandra.
+type healthServer struct {
+	sync       *Sync
+	rabbit     func() bool
+	cassandra  func() bool
+	maxPending int
+}
+
+func (h *healthServer) health() Health {
+	health := Health{
+		Rabbit:       connectionState(h.rabbit()),
+		Cassandra:    "unused",
+		Gremlin:      connectionState(h.sync.backend.Connected()),
+		Pending:      h.sync.pendingCount(),
+		DeleteChecks: atomic.LoadInt64(&h.sync.deleteChecks),
+	}
+	if h.cassandra != nil {
+		health.Cassandra = connectionState(h.cassandra())
+	}
+	if t, ok := h.sync.lastProcessed.Load().(time.Time); ok {
+		health.LastProcessed = &t
+	}
+	return health
+}
+
+// healthz reports if gremlin-sync is alive. It is not when the
+// rabbitmq connection is lost, since notifications are not received
+// anymore, or when too many notifications are pending.
+func (h *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	ok := health.Rabbit == "connected" && health.Pending <= h.maxPending
+	writeHealth(w, health, ok)
+}
+
+// readyz reports if gremlin-sync is connected to all its
+// dependencies and applies notifications to the graph
+func (h *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	health := h.health()
+	ok := health.Rabbit == "connected" && health.Gremlin == "connected" &&
+		health.Cassandra != "disconnected" && h.sync.pendingProcessing.Load() == false
+	writeHealth(w, health, ok)
+}
+
+func writeHealth(w http.ResponseWriter, health Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+func (h *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/metrics", h.sync.serveMetrics)
+	if h.sync.events != nil {
+		mux.HandleFunc("/events", h.sync.events.serveEvents)
+	}
+	return mux
+}
+
+func (h *healthServer) listen(addr string) {
+	log.Noticef("Listening on %s", addr)
+	if err := http.ListenAndServe(addr, h.handler()); err != nil {
+		log.Fatalf("Failed to listen on %s: %s", addr, err)
+	}
+}
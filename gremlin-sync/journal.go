@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// JournalCompactLines is the number of lines added to the
+// journal, beyond the pending notifications, before it is compacted
+const JournalCompactLines = 1000
+
+// journal is a write-ahead log of the pending notifications. Each
+// pending notification is appended to the journal before it is acked
+// to rabbitmq. The journal is rewritten with the pending list when
+// the pending notifications are processed or when it grows too much.
+type journal struct {
+	path  string
+	f     *os.File
+	lines int
+	sync.Mutex
+}
+
+// openJournal opens the journal at path and returns the pending
+// notifications it contains, coalesced like when they were added
+func openJournal(path string) (*journal, []Notification, error) {
+	pending := []Notification{}
+	lines := 0
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			n := Notification{}
+			// a partial line is left by a crash while writing it
+			if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+				log.Warningf("Skipping invalid journal line: %s", scanner.Text())
+				continue
+			}
+			pending = addPendingNotification(pending, n)
+			lines++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, nil, err
+	}
+	j := &journal{path: path, lines: lines}
+	// rewrite the journal to drop coalesced and invalid lines
+	if err := j.compact(pending); err != nil {
+		return nil, nil, err
+	}
+	return j, pending, nil
+}
+
+// add appends n to the journal. pending is the pending list
+// with n added, used to compact the journal when needed.
+func (j *journal) add(n Notification, pending []Notification) error {
+	j.Lock()
+	defer j.Unlock()
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.lines++
+	if j.lines > len(pending)+JournalCompactLines {
+		return j.rewrite(pending)
+	}
+	return nil
+}
+
+// compact atomically replaces the journal with the pending list
+func (j *journal) compact(pending []Notification) error {
+	j.Lock()
+	defer j.Unlock()
+	return j.rewrite(pending)
+}
+
+func (j *journal) rewrite(pending []Notification) error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, n := range pending {
+		data, err := json.Marshal(n)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.lines = len(pending)
+	return nil
+}
+
+func (j *journal) close() error {
+	j.Lock()
+	defer j.Unlock()
+	return j.f.Close()
+}
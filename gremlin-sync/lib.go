@@ -1,10 +1,21 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/streadway/amqp"
 )
 
-func setupRabbit(rabbitURI string, rabbitVHost string, rabbitQueue string) (*amqp.Connection, *amqp.Channel, <-chan amqp.Delivery) {
+// setupRabbit connects to rabbitmq and consumes the contrail
+// notifications. By default the queue is exclusive and expires
+// 180s after gremlin-sync is stopped. When durable is true, the
+// queue is persistent and kept when gremlin-sync is stopped so
+// that notifications sent in between are not lost. prefetch is the
+// number of notifications delivered before they are acked. When
+// deadLetterExchange is set, rejected notifications are sent to this
+// exchange and kept in the dead-letter queue of rabbitQueue.
+func setupRabbit(rabbitURI string, rabbitVHost string, rabbitQueue string, durable bool, prefetch int, deadLetterExchange string) (*amqp.Connection, *amqp.Channel, <-chan amqp.Delivery) {
 	log.Notice("Connecting to RabbitMQ...")
 
 	conn, err := amqp.DialConfig(rabbitURI, amqp.Config{Vhost: rabbitVHost})
@@ -17,14 +28,40 @@ func setupRabbit(rabbitURI string, rabbitVHost string, rabbitQueue string) (*amq
 		log.Fatalf("Failed to open channel: %s", err)
 	}
 
-	q, err := ch.QueueDeclare(
-		rabbitQueue, // name
-		false,       // durable
-		false,       // delete when unused
-		true,        // exclusive
-		false,       // no-wait
-		amqp.Table{"x-expires": int32(180000)}, // arguments
-	)
+	args := amqp.Table{}
+	if deadLetterExchange != "" {
+		if err := setupDeadLetter(ch, rabbitQueue, deadLetterExchange); err != nil {
+			log.Fatalf("Failed to create dead-letter queue: %s", err)
+		}
+		args["x-dead-letter-exchange"] = deadLetterExchange
+	}
+
+	var q amqp.Queue
+	if durable {
+		q, err = ch.QueueDeclare(
+			rabbitQueue, // name
+			true,        // durable
+			false,       // delete when unused
+			false,       // exclusive
+			false,       // no-wait
+			args,        // arguments
+		)
+	} else {
+		args["x-expires"] = int32(180000)
+		q, err = ch.QueueDeclare(
+			rabbitQueue, // name
+			false,       // durable
+			false,       // delete when unused
+			true,        // exclusive
+			false,       // no-wait
+			args,        // arguments
+		)
+	}
+	// rabbitmq refuses to change the arguments of an existing queue
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.PreconditionFailed {
+		log.Fatalf("Failed to create queue: %s. The queue %s exists with other arguments, "+
+			"delete it with --rabbit-delete-queue to add or remove the dead-letter exchange", err, rabbitQueue)
+	}
 	if err != nil {
 		log.Fatalf("Failed to create queue: %s", err)
 	}
@@ -40,6 +77,15 @@ func setupRabbit(rabbitURI string, rabbitVHost string, rabbitQueue string) (*amq
 		log.Fatalf("Failed to bind queue: %s", err)
 	}
 
+	err = ch.Qos(
+		prefetch, // prefetch count
+		0,        // prefetch size
+		false,    // global
+	)
+	if err != nil {
+		log.Fatalf("Failed to set QoS: %s", err)
+	}
+
 	msgs, err := ch.Consume(
 		q.Name, // queue
 		"",     // consumer
@@ -58,7 +104,12 @@ func setupRabbit(rabbitURI string, rabbitVHost string, rabbitQueue string) (*amq
 	return conn, ch, msgs
 }
 
-func teardownRabbit(conn *amqp.Connection, ch *amqp.Channel, rabbitQueue string) error {
+// teardownRabbit closes the connection to rabbitmq. The queue
+// is deleted unless it is durable.
+func teardownRabbit(conn *amqp.Connection, ch *amqp.Channel, rabbitQueue string, durable bool) error {
+	if durable {
+		return conn.Close()
+	}
 	err := ch.QueueUnbind(rabbitQueue, "", VncExchange, amqp.Table{})
 	if err != nil {
 		return err
@@ -69,3 +120,190 @@ func teardownRabbit(conn *amqp.Connection, ch *amqp.Channel, rabbitQueue string)
 	}
 	return conn.Close()
 }
+
+// deleteRabbitQueue unbinds and deletes a durable queue
+// when it is not used by gremlin-sync anymore
+func deleteRabbitQueue(rabbitURI string, rabbitVHost string, rabbitQueue string) error {
+	conn, err := amqp.DialConfig(rabbitURI, amqp.Config{Vhost: rabbitVHost})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	err = ch.QueueUnbind(rabbitQueue, "", VncExchange, amqp.Table{})
+	if err != nil {
+		return err
+	}
+	n, err := ch.QueueDelete(rabbitQueue, false, false, false)
+	if err != nil {
+		return err
+	}
+	log.Noticef("Deleted queue %s with %d pending notifications", rabbitQueue, n)
+	return nil
+}
+
+func deadLetterQueue(rabbitQueue string) string {
+	return rabbitQueue + ".dead"
+}
+
+// setupDeadLetter declares the dead-letter exchange and the
+// durable queue where rejected notifications are kept
+func setupDeadLetter(ch *amqp.Channel, rabbitQueue string, deadLetterExchange string) error {
+	err := ch.ExchangeDeclare(
+		deadLetterExchange, // name
+		"fanout",           // type
+		true,               // durable
+		false,              // auto-deleted
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(
+		deadLetterQueue(rabbitQueue), // name
+		true,                         // durable
+		false,                        // delete when unused
+		false,                        // exclusive
+		false,                        // no-wait
+		nil,                          // arguments
+	)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(q.Name, "", deadLetterExchange, false, nil)
+}
+
+// listDeadLetters prints the notifications of the dead-letter queue.
+// They are left in the queue.
+func listDeadLetters(rabbitURI string, rabbitVHost string, rabbitQueue string) error {
+	conn, err := amqp.DialConfig(rabbitURI, amqp.Config{Vhost: rabbitVHost})
+	if err != nil {
+		return err
+	}
+	// unacked messages are requeued when the connection is closed
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for {
+		d, ok, err := ch.Get(deadLetterQueue(rabbitQueue), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		count++
+		t, reason := deadLetterDeath(d.Headers)
+		fmt.Printf("%s %s %s\n", t.Format(time.RFC3339), reason, d.Body)
+	}
+	log.Noticef("%d notifications in %s", count, deadLetterQueue(rabbitQueue))
+	return nil
+}
+
+// deadLetterDeath returns the time and the reason of the last
+// dead-lettering of a notification, from the x-death header
+// added by rabbitmq. contrail doesn't set the publishing time.
+func deadLetterDeath(headers amqp.Table) (time.Time, string) {
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return time.Time{}, "unknown"
+	}
+	// the most recent death is first
+	death, _ := deaths[0].(amqp.Table)
+	t, _ := death["time"].(time.Time)
+	reason, ok := death["reason"].(string)
+	if !ok {
+		reason = "unknown"
+	}
+	return t.UTC(), reason
+}
+
+// checkQueue returns an error when the queue doesn't exist
+func checkQueue(conn *amqp.Connection, queue string) error {
+	// a failed passive declare closes the channel
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	_, err = ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+	if e, ok := err.(*amqp.Error); ok {
+		switch e.Code {
+		case amqp.NotFound:
+			return fmt.Errorf("queue %s does not exist, start gremlin-sync first", queue)
+		// the exclusive queue of a running gremlin-sync
+		case amqp.ResourceLocked:
+			return nil
+		}
+	}
+	return err
+}
+
+// replayDeadLetters moves the notifications of the dead-letter
+// queue back to the queue of gremlin-sync. A dead letter is only
+// acked once rabbitmq has confirmed that it was routed to the queue.
+func replayDeadLetters(rabbitURI string, rabbitVHost string, rabbitQueue string) error {
+	conn, err := amqp.DialConfig(rabbitURI, amqp.Config{Vhost: rabbitVHost})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := checkQueue(conn, rabbitQueue); err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	// returns are received before the confirmation of the publishing
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	count := 0
+	for {
+		d, ok, err := ch.Get(deadLetterQueue(rabbitQueue), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		// published on the default exchange so that only
+		// gremlin-sync receives the notification again
+		err = ch.Publish("", rabbitQueue, true, false, amqp.Publishing{
+			ContentType: d.ContentType,
+			Body:        d.Body,
+		})
+		if err != nil {
+			d.Nack(false, true)
+			return err
+		}
+		confirm := <-confirms
+		select {
+		case r := <-returns:
+			d.Nack(false, true)
+			return fmt.Errorf("notification not routed to %s: %s", rabbitQueue, r.ReplyText)
+		default:
+		}
+		if !confirm.Ack {
+			d.Nack(false, true)
+			return fmt.Errorf("notification not confirmed by rabbitmq")
+		}
+		if err := d.Ack(false); err != nil {
+			return err
+		}
+		count++
+	}
+	log.Noticef("Replayed %d notifications from %s", count, deadLetterQueue(rabbitQueue))
+	return nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"os/signal"
 	"sync"
@@ -25,6 +27,16 @@ var (
 	// DeleteInterval is the time to wait before checking if
 	// a resource was correctly deleted from the contrail db
 	DeleteInterval = 3 * time.Second
+	// RetryDelay is the time to wait before requeuing
+	// a notification that failed
+	RetryDelay = 1 * time.Second
+	// ErrInvalidNotification indicates a notification that
+	// can't be processed and is dead-lettered right away
+	ErrInvalidNotification = errors.New("invalid notification")
+	// ErrPending indicates a notification that failed because
+	// gremlin server is disconnected and that was added to the
+	// pending list to be processed once connected again
+	ErrPending = errors.New("notification is pending")
 )
 
 const (
@@ -32,6 +44,11 @@ const (
 	VncExchange = "vnc_config.object-update"
 	// QueueName is the rabbitmq queue for the sync process
 	QueueName = "gremlin.sync"
+	// Workers default number of notifications processed in parallel
+	Workers = 4
+	// MaxRetries default number of times a failed notification
+	// is requeued before it is dead-lettered
+	MaxRetries = 5
 )
 
 // Notification represent rabbitmq notifications from contrail-api
@@ -43,22 +60,46 @@ type Notification struct {
 
 // Sync represent the state of the sync process
 type Sync struct {
+	deleteChecks      int64 // first for 64-bit alignment of atomic operations
 	backend           *g.ServerBackend
-	session           gockle.Session
+	reader            utils.ResourceReader
 	msgs              <-chan amqp.Delivery
 	pending           []Notification
+	processing        []Notification
+	pendingMutex      sync.Mutex
 	pendingProcessing atomic.Value
+	lastProcessed     atomic.Value
+	metrics           *syncMetrics
+	journal           *journal
+	recorder          *recorder
+	events            *eventStream
+	workers           int
+	locks             []sync.Mutex
+	maxRetries        int
+	retries           map[string]int
+	retriesMutex      sync.Mutex
 	wg                *sync.WaitGroup
 }
 
+// job is a notification processed by a worker
+type job struct {
+	n Notification
+	d amqp.Delivery
+}
+
 // NewSync returns the sync process
-func NewSync(session gockle.Session, msgs <-chan amqp.Delivery, gremlinURI string) *Sync {
+func NewSync(reader utils.ResourceReader, msgs <-chan amqp.Delivery, gremlinURI string) *Sync {
 	s := &Sync{
-		backend: g.NewServerBackend(gremlinURI),
-		session: session,
-		msgs:    msgs,
-		pending: []Notification{},
-		wg:      &sync.WaitGroup{},
+		backend:    g.NewServerBackend(gremlinURI),
+		reader:     reader,
+		msgs:       msgs,
+		pending:    []Notification{},
+		workers:    1,
+		locks:      make([]sync.Mutex, 1),
+		maxRetries: MaxRetries,
+		retries:    make(map[string]int),
+		metrics:    newSyncMetrics(),
+		wg:         &sync.WaitGroup{},
 	}
 	s.pendingProcessing.Store(false)
 	s.backend.AddConnectedHandler(s.onConnected)
@@ -66,6 +107,36 @@ func NewSync(session gockle.Session, msgs <-chan amqp.Delivery, gremlinURI strin
 	return s
 }
 
+// SetWorkers sets the number of notifications processed in
+// parallel. It must be called before synchronize.
+func (s *Sync) SetWorkers(workers int) {
+	s.workers = workers
+	s.locks = make([]sync.Mutex, workers)
+}
+
+// lockResource locks the partition of the resource id and returns
+// the function that unlocks it. Notifications of a partition are
+// processed by one worker, the lock prevents the reconciliation
+// and the delete checks to write the resource concurrently.
+func (s *Sync) lockResource(id uuid.UUID) func() {
+	l := &s.locks[partition(id, len(s.locks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// SetCluster restricts the sync process to the vertices of the
+// cluster so that several clusters can be synced in the same graph.
+// It must be called before start.
+func (s *Sync) SetCluster(cluster string) {
+	s.backend.SetCluster(cluster)
+}
+
+// SetMaxRetries sets the number of times a failed
+// notification is requeued before it is dead-lettered
+func (s *Sync) SetMaxRetries(maxRetries int) {
+	s.maxRetries = maxRetries
+}
+
 func (s *Sync) start() {
 	log.Notice("Connecting to Gremlin Server...")
 	s.backend.Start()
@@ -79,7 +150,7 @@ func (s *Sync) stop() {
 
 func (s *Sync) onConnected() {
 	log.Notice("Connected to Gremlin Server")
-	if len(s.pending) > 0 {
+	if s.pendingCount() > 0 {
 		s.pendingProcessing.Store(true)
 		s.processPendingNotifications()
 		s.pendingProcessing.Store(false)
@@ -92,11 +163,39 @@ func (s *Sync) onDisconnected(err error) {
 	}
 }
 
+// synchronize dispatches notifications to the workers. Notifications
+// are partitioned by uuid so that the notifications of a resource
+// are processed in order by the same worker.
 func (s *Sync) synchronize() {
 	log.Debug("Listening for updates")
+	queues := make([]chan job, s.workers)
+	workers := &sync.WaitGroup{}
+	for i := range queues {
+		queues[i] = make(chan job, s.workers)
+		workers.Add(1)
+		go s.worker(queues[i], workers)
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+		workers.Wait()
+	}()
+
 	for d := range s.msgs {
 		n := Notification{}
-		json.Unmarshal(d.Body, &n)
+		if err := json.Unmarshal(d.Body, &n); err != nil {
+			log.Errorf("Invalid notification %s: %s", d.Body, err)
+			s.metrics.failures.inc("invalid")
+			s.ack(d, ErrInvalidNotification)
+			continue
+		}
+		s.metrics.received.inc(n.Oper, n.Type)
+		if s.recorder != nil {
+			if err := s.recorder.record(n, time.Now()); err != nil {
+				log.Errorf("Failed to record notification: %s", err)
+			}
+		}
 
 		if s.backend.Connected() == false {
 			s.handlePendingNotification(n)
@@ -108,120 +207,300 @@ func (s *Sync) synchronize() {
 			time.Sleep(200 * time.Millisecond)
 		}
 
-		if err := s.handleNotification(n); err != nil {
-			d.Ack(false)
-		} else {
+		queues[partition(n.UUID, len(queues))] <- job{n: n, d: d}
+	}
+}
+
+func (s *Sync) worker(jobs chan job, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j := range jobs {
+		start := time.Now()
+		err := s.handleNotification(j.n)
+		if err == nil {
+			s.applied(j.n, start)
+		}
+		s.ack(j.d, err)
+	}
+}
+
+// ack acknowledges a notification according to the result of its
+// processing. Failed notifications are requeued up to maxRetries
+// times and then rejected. Rejected notifications go to the
+// dead-letter exchange of the queue when there is one.
+func (s *Sync) ack(d amqp.Delivery, err error) {
+	key := string(d.Body)
+	switch err {
+	// a resource not found has been deleted since the notification
+	case nil, utils.ErrResourceNotFound, ErrPending:
+		s.forgetRetries(key)
+		d.Ack(false)
+	// not added to the pending list because it is being processed,
+	// the notification is not at fault so retries are not counted
+	case gremlin.ErrConnectionClosed:
+		time.Sleep(RetryDelay)
+		d.Nack(false, true)
+	case ErrInvalidNotification:
+		log.Errorf("Rejecting invalid notification %s", d.Body)
+		d.Nack(false, false)
+	// retrying won't help until the vertex of the other cluster is deleted
+	case g.ErrClusterConflict:
+		log.Errorf("Rejecting notification %s: %s", d.Body, err)
+		d.Nack(false, false)
+	default:
+		if retries := s.addRetry(key); retries > s.maxRetries {
+			log.Errorf("Rejecting notification %s after %d retries", d.Body, s.maxRetries)
+			s.forgetRetries(key)
 			d.Nack(false, false)
+		} else {
+			time.Sleep(RetryDelay)
+			d.Nack(false, true)
 		}
 	}
 }
 
+func (s *Sync) addRetry(key string) int {
+	s.retriesMutex.Lock()
+	defer s.retriesMutex.Unlock()
+	s.retries[key]++
+	return s.retries[key]
+}
+
+func (s *Sync) forgetRetries(key string) {
+	s.retriesMutex.Lock()
+	defer s.retriesMutex.Unlock()
+	delete(s.retries, key)
+}
+
+// partition returns the worker of the resource id
+func partition(id uuid.UUID, workers int) int {
+	h := fnv.New32a()
+	h.Write(id.Bytes())
+	return int(h.Sum32() % uint32(workers))
+}
+
+func (s *Sync) pendingCount() int {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	return len(s.processing) + len(s.pending)
+}
+
+// EnableJournal stores the pending notifications in a journal
+// at path. Notifications left in the journal by a previous run
+// are processed once connected to gremlin-server.
+func (s *Sync) EnableJournal(path string) error {
+	j, pending, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	s.journal = j
+	s.pending = pending
+	if len(pending) > 0 {
+		log.Noticef("Loaded %d pending notifications from %s", len(pending), path)
+	}
+	return nil
+}
+
 func (s *Sync) handlePendingNotification(n Notification) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	s.pending = addPendingNotification(s.pending, n)
+	if s.journal != nil {
+		if err := s.journal.add(n, s.journalNotifications()); err != nil {
+			log.Errorf("Failed to write journal: %s", err)
+		}
+	}
+}
+
+// addPendingNotification adds n to the pending list. Previous
+// notifications of the resource are removed on DELETE and
+// previous updates are removed on UPDATE.
+func addPendingNotification(pending []Notification, n Notification) []Notification {
 	switch n.Oper {
 	// On DELETE, remove previous notifications in the pending list
 	case "DELETE":
-		for i := 0; i < len(s.pending); i++ {
-			n2 := s.pending[i]
+		for i := 0; i < len(pending); i++ {
+			n2 := pending[i]
 			if n2.UUID == n.UUID {
-				s.pending = s.removePendingNotification(s.pending, n2, i)
+				pending = removePendingNotification(pending, n2, i)
 				i--
 			}
 		}
 	// Reduce resource updates
 	case "UPDATE":
-		for i := 0; i < len(s.pending); i++ {
-			n2 := s.pending[i]
+		for i := 0; i < len(pending); i++ {
+			n2 := pending[i]
 			if n2.UUID == n.UUID && n2.Oper == n.Oper {
-				s.pending = s.removePendingNotification(s.pending, n2, i)
+				pending = removePendingNotification(pending, n2, i)
 				i--
 			}
 		}
 	}
-	s.pending = append(s.pending, n)
 	log.Debugf("[%s] %s/%s [+]", n.Oper, n.Type, n.UUID)
+	return append(pending, n)
 }
 
-func (s *Sync) removePendingNotification(p []Notification, n Notification, i int) []Notification {
+func removePendingNotification(p []Notification, n Notification, i int) []Notification {
 	log.Debugf("[%s] %s/%s [-]", n.Oper, n.Type, n.UUID)
 	return append(p[:i], p[i+1:]...)
 }
 
+// journalNotifications returns the notifications that are
+// not processed yet, in the order they are processed
+func (s *Sync) journalNotifications() []Notification {
+	if len(s.processing) == 0 {
+		return s.pending
+	}
+	return append(append([]Notification{}, s.processing...), s.pending...)
+}
+
+// processPendingNotifications takes the pending list and processes
+// it without holding pendingMutex, so that the health and metrics
+// endpoints are not blocked. Notifications added in the meantime
+// are processed the next time.
 func (s *Sync) processPendingNotifications() {
 	log.Debugf("Processing pending notifications...")
-	pending := s.pending
-	for _, n := range pending {
+	s.pendingMutex.Lock()
+	s.processing, s.pending = s.pending, nil
+	s.pendingMutex.Unlock()
+	defer s.restorePendingNotifications()
+	for {
+		s.pendingMutex.Lock()
+		if len(s.processing) == 0 {
+			s.pendingMutex.Unlock()
+			break
+		}
+		n := s.processing[0]
+		s.pendingMutex.Unlock()
+		start := time.Now()
 		err := s.handleNotification(n)
 		if err == gremlin.ErrConnectionClosed {
 			log.Errorf("Disconnected while processing pending list.")
 			return
 		}
-		s.pending = s.pending[1:]
+		if err == nil {
+			s.applied(n, start)
+		}
+		s.pendingMutex.Lock()
+		s.processing = s.processing[1:]
+		s.pendingMutex.Unlock()
 	}
 	log.Debugf("Done.")
 }
 
-func (s *Sync) handleNotificationError(n Notification, err error) error {
+// restorePendingNotifications puts the notifications that were not
+// processed back in the pending list, before the ones added while
+// processing, and compacts the journal
+func (s *Sync) restorePendingNotifications() {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	pending := s.processing
+	for _, n := range s.pending {
+		pending = addPendingNotification(pending, n)
+	}
+	s.pending, s.processing = pending, nil
+	if s.journal != nil {
+		if err := s.journal.compact(s.pending); err != nil {
+			log.Errorf("Failed to compact journal: %s", err)
+		}
+	}
+}
+
+// applied records a notification applied to the graph
+// whose processing started at start
+func (s *Sync) applied(n Notification, start time.Time) {
+	now := time.Now()
+	s.lastProcessed.Store(now)
+	s.metrics.applied.inc(n.Oper, n.Type)
+	s.metrics.duration.observe(now.Sub(start).Seconds())
+}
+
+// failureReason returns the reason of a failed notification
+// reported in metrics. stage is read or write depending
+// on where the notification processing failed.
+func failureReason(err error, stage string) string {
+	switch err {
+	case utils.ErrResourceNotFound:
+		return "not_found"
+	case gremlin.ErrConnectionClosed:
+		return "disconnected"
+	case g.ErrClusterConflict:
+		return "conflict"
+	default:
+		return stage
+	}
+}
+
+func (s *Sync) handleNotificationError(n Notification, err error, stage string) error {
 	log.Errorf("[%s] %s/%s failed: %s", n.Oper, n.Type, n.UUID, err)
+	s.metrics.failures.inc(failureReason(err, stage))
 	if s.pendingProcessing.Load() == false && err == gremlin.ErrConnectionClosed {
 		s.handlePendingNotification(n)
+		return ErrPending
 	}
 	return err
 }
 
 func (s *Sync) handleNotification(n Notification) error {
 	log.Debugf("[%s] %s/%s", n.Oper, n.Type, n.UUID)
+	defer s.lockResource(n.UUID)()
 	switch n.Oper {
 	case "CREATE":
-		vertex, err := utils.GetContrailResource(s.session, n.UUID)
+		vertex, err := s.reader.GetResource(n.UUID)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "read")
 		}
-		err = s.backend.CreateVertex(vertex)
+		err = s.writeVertex(vertex)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "write")
 		}
+		s.metrics.observeLag(vertex)
 		return nil
 	case "UPDATE":
-		vertex, err := utils.GetContrailResource(s.session, n.UUID)
+		vertex, err := s.reader.GetResource(n.UUID)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "read")
 		}
-		err = s.backend.UpdateVertex(vertex)
+		err = s.writeVertex(vertex)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "write")
 		}
+		s.metrics.observeLag(vertex)
 		return nil
 	case "DELETE":
 		now := time.Now()
 		vertex := g.Vertex{ID: n.UUID, Label: n.Type}
-		err := s.backend.UpdateVertexProperty(vertex, "deleted", now.Unix())
+		err := s.markDeleted(vertex, now)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "write")
 		}
 		s.checkDeleteLater(vertex, n)
 		return nil
 	default:
 		log.Errorf("Notification not handled: %s", n)
-		return nil
+		s.metrics.failures.inc("invalid")
+		return ErrInvalidNotification
 	}
 }
 
 func (s *Sync) checkDeleteLater(v g.Vertex, n Notification) {
+	atomic.AddInt64(&s.deleteChecks, 1)
+	s.wg.Add(1)
 	go func() {
-		s.wg.Add(1)
 		defer s.wg.Done()
+		defer atomic.AddInt64(&s.deleteChecks, -1)
 		time.Sleep(DeleteInterval)
 		s.checkDelete(v, n)
 	}()
 }
 
-func (s Sync) checkDelete(v g.Vertex, n Notification) error {
-	cv, err := utils.GetContrailResource(s.session, v.ID)
+func (s *Sync) checkDelete(v g.Vertex, n Notification) error {
+	defer s.lockResource(v.ID)()
+	cv, err := s.reader.GetResource(v.ID)
 	switch err {
 	case utils.ErrResourceNotFound:
-		err := s.backend.DeleteVertex(v)
+		err := s.dropVertex(v)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "write")
 		}
 	// the vertex is still present in the DB
 	// but should have been deleted
@@ -232,9 +511,9 @@ func (s Sync) checkDelete(v g.Vertex, n Notification) error {
 			cv.Label = v.Label
 			cv.Properties["deleted"] = v.Properties["deleted"]
 		}
-		err := s.backend.UpdateVertex(cv)
+		err := s.writeVertex(cv)
 		if err != nil {
-			return s.handleNotificationError(n, err)
+			return s.handleNotificationError(n, err, "write")
 		}
 	default:
 		log.Errorf("Failed to retrieve resource %s from db: %s", v.ID, err)
@@ -243,30 +522,128 @@ func (s Sync) checkDelete(v g.Vertex, n Notification) error {
 	return nil
 }
 
-func setup(gremlinURI string, cassandraCluster []string, rabbitURI string, rabbitVHost string, rabbitQueue string) {
+// setupReader returns the reader of the source. session is
+// nil when resources are not read from cassandra.
+func setupReader(source string, cassandraCluster []string, contrailAPIURL string, contrailAPIToken string) (gockle.Session, utils.ResourceReader) {
+	switch source {
+	case "cassandra":
+		log.Notice("Connecting to Cassandra...")
+		session, err := utils.SetupCassandra(cassandraCluster)
+		if err != nil {
+			log.Fatalf("Failed to connect to Cassandra: %s", err)
+		}
+		log.Notice("Connected.")
+		return session, utils.NewCassandraReader(session)
+	case "contrail-api":
+		return nil, utils.NewContrailAPIReader(contrailAPIURL, contrailAPIToken)
+	default:
+		log.Fatalf("Unknown source %s", source)
+	}
+	return nil, nil
+}
+
+// setupReplay replays the notifications of the recording at
+// path against the source and gremlin server, then exits
+func setupReplay(gremlinURI string, cluster string, source string, cassandraCluster []string, contrailAPIURL string, contrailAPIToken string, path string, fast bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open recording %s: %s", path, err)
+	}
+	defer f.Close()
+
+	session, reader := setupReader(source, cassandraCluster, contrailAPIURL, contrailAPIToken)
+	if session != nil {
+		defer session.Close()
+	}
+
+	sync := NewSync(reader, nil, gremlinURI)
+	sync.SetCluster(cluster)
+	sync.start()
+	defer sync.stop()
+	for !sync.backend.Connected() {
+		time.Sleep(time.Second)
+	}
+
+	log.Noticef("Replaying %s...", path)
+	r, err := replay(f, fast, sync.handleNotification)
+	if err != nil {
+		log.Errorf("Failed to read recording %s: %s", path, err)
+	}
+	log.Noticef("Replayed %d notifications in %0.2fs, %d failed",
+		r.Replayed, r.Duration.Seconds(), r.Failed)
+}
+
+func setup(gremlinURI string, cluster string, source string, cassandraCluster []string, contrailAPIURL string, contrailAPIToken string, rabbitURI string, rabbitVHost string, rabbitQueue string, rabbitDurable bool, journalPath string, recordPath string, reconcileInterval time.Duration, workers int, maxRetries int, deadLetterExchange string, httpAddr string, maxPending int, events bool, webhooks []string) {
 	var (
-		conn    *amqp.Connection
-		ch      *amqp.Channel
-		msgs    <-chan amqp.Delivery
-		session gockle.Session
-		err     error
+		conn *amqp.Connection
+		ch   *amqp.Channel
+		msgs <-chan amqp.Delivery
 	)
 
-	log.Notice("Connecting to Cassandra...")
-	session, err = utils.SetupCassandra(cassandraCluster)
-	if err != nil {
-		log.Fatalf("Failed to connect to Cassandra: %s", err)
+	session, reader := setupReader(source, cassandraCluster, contrailAPIURL, contrailAPIToken)
+	if session != nil {
+		defer session.Close()
 	}
-	log.Notice("Connected.")
-	defer session.Close()
 
-	conn, ch, msgs = setupRabbit(rabbitURI, rabbitVHost, rabbitQueue)
-	defer teardownRabbit(conn, ch, rabbitQueue)
+	conn, ch, msgs = setupRabbit(rabbitURI, rabbitVHost, rabbitQueue, rabbitDurable, workers, deadLetterExchange)
+	defer teardownRabbit(conn, ch, rabbitQueue, rabbitDurable)
 
-	sync := NewSync(session, msgs, gremlinURI)
+	sync := NewSync(reader, msgs, gremlinURI)
+	sync.SetCluster(cluster)
+	sync.SetWorkers(workers)
+	sync.SetMaxRetries(maxRetries)
+	if journalPath != "" {
+		if err := sync.EnableJournal(journalPath); err != nil {
+			log.Fatalf("Failed to open journal %s: %s", journalPath, err)
+		}
+		defer sync.journal.close()
+	}
+	if recordPath != "" {
+		if err := sync.EnableRecord(recordPath); err != nil {
+			log.Fatalf("Failed to open recording %s: %s", recordPath, err)
+		}
+		defer sync.recorder.close()
+	}
+	if events || len(webhooks) > 0 {
+		sync.EnableEvents()
+		for _, url := range webhooks {
+			go sync.events.deliver(url)
+		}
+	}
 	go sync.synchronize()
 	sync.start()
 	defer sync.stop()
+	if reconcileInterval > 0 {
+		if session != nil {
+			go sync.reconcileEvery(session, reconcileInterval)
+		} else {
+			log.Warning("Reconciliation is only available with the cassandra source")
+		}
+	}
+
+	if httpAddr != "" {
+		var rabbitConnected atomic.Value
+		rabbitConnected.Store(true)
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		go func() {
+			if err := <-closed; err != nil {
+				log.Errorf("Disconnected from RabbitMQ: %s", err)
+			}
+			rabbitConnected.Store(false)
+		}()
+		h := &healthServer{
+			sync:       sync,
+			rabbit:     func() bool { return rabbitConnected.Load().(bool) },
+			maxPending: maxPending,
+		}
+		if session != nil {
+			h.cassandra = func() bool {
+				var version string
+				return session.Scan(`SELECT release_version FROM system.local`, []interface{}{&version}) == nil
+			}
+		}
+		go h.listen(httpAddr)
+	}
 
 	log.Notice("To exit press CTRL+C")
 	c := make(chan os.Signal, 1)
@@ -283,12 +660,34 @@ func main() {
 		Desc:   "host:port of gremlin server",
 		EnvVar: "GREMLIN_SYNC_GREMLIN_SERVER",
 	})
+	cluster := app.String(cli.StringOpt{
+		Name:   "cluster",
+		Desc:   "name of the contrail cluster, to sync several clusters in the same graph",
+		EnvVar: "GREMLIN_SYNC_CLUSTER",
+	})
+	source := app.String(cli.StringOpt{
+		Name:   "source",
+		Value:  "cassandra",
+		Desc:   "where to read contrail resources from (cassandra or contrail-api)",
+		EnvVar: "GREMLIN_SYNC_SOURCE",
+	})
 	cassandraSrvs := app.Strings(cli.StringsOpt{
 		Name:   "cassandra",
 		Value:  []string{"localhost"},
 		Desc:   "list of host of cassandra nodes, uses CQL port 9042",
 		EnvVar: "GREMLIN_SYNC_CASSANDRA_SERVERS",
 	})
+	contrailAPISrv := app.String(cli.StringOpt{
+		Name:   "contrail-api",
+		Value:  "localhost:8082",
+		Desc:   "host:port of contrail-api server",
+		EnvVar: "GREMLIN_SYNC_CONTRAIL_API_SERVER",
+	})
+	contrailAPIToken := app.String(cli.StringOpt{
+		Name:   "contrail-api-token",
+		Desc:   "keystone token for contrail-api server",
+		EnvVar: "GREMLIN_SYNC_CONTRAIL_API_TOKEN",
+	})
 	rabbitSrv := app.String(cli.StringOpt{
 		Name:   "rabbit",
 		Value:  "localhost:5672",
@@ -318,13 +717,138 @@ func main() {
 		Desc:   "name of rabbitmq name",
 		EnvVar: "GREMLIN_SYNC_RABBIT_QUEUE",
 	})
+	rabbitDurable := app.Bool(cli.BoolOpt{
+		Name:   "rabbit-durable",
+		Value:  false,
+		Desc:   "use a durable queue kept when gremlin-sync is stopped",
+		EnvVar: "GREMLIN_SYNC_RABBIT_DURABLE",
+	})
+	rabbitDeleteQueue := app.Bool(cli.BoolOpt{
+		Name:   "rabbit-delete-queue",
+		Value:  false,
+		Desc:   "delete the durable queue and exit",
+		EnvVar: "GREMLIN_SYNC_RABBIT_DELETE_QUEUE",
+	})
+	journalPath := app.String(cli.StringOpt{
+		Name:   "journal",
+		Desc:   "file where notifications are kept while gremlin server is not connected",
+		EnvVar: "GREMLIN_SYNC_JOURNAL",
+	})
+	recordPath := app.String(cli.StringOpt{
+		Name:   "record",
+		Desc:   "file where received notifications are recorded",
+		EnvVar: "GREMLIN_SYNC_RECORD",
+	})
+	replayPath := app.String(cli.StringOpt{
+		Name:   "replay",
+		Desc:   "replay the notifications recorded in this file and exit",
+		EnvVar: "GREMLIN_SYNC_REPLAY",
+	})
+	replayFast := app.Bool(cli.BoolOpt{
+		Name:   "replay-fast",
+		Value:  false,
+		Desc:   "replay notifications as fast as possible instead of at their original pace",
+		EnvVar: "GREMLIN_SYNC_REPLAY_FAST",
+	})
+	reconcileInterval := app.String(cli.StringOpt{
+		Name:   "reconcile-interval",
+		Value:  "0",
+		Desc:   "interval between reconciliations of the graph with cassandra, the first one runs at startup (0 to disable), eg: 1h",
+		EnvVar: "GREMLIN_SYNC_RECONCILE_INTERVAL",
+	})
+	workers := app.Int(cli.IntOpt{
+		Name:   "workers",
+		Value:  Workers,
+		Desc:   "number of notifications processed in parallel",
+		EnvVar: "GREMLIN_SYNC_WORKERS",
+	})
+	maxRetries := app.Int(cli.IntOpt{
+		Name:   "max-retries",
+		Value:  MaxRetries,
+		Desc:   "number of times a failed notification is retried before it is dead-lettered",
+		EnvVar: "GREMLIN_SYNC_MAX_RETRIES",
+	})
+	deadLetterExchange := app.String(cli.StringOpt{
+		Name:   "rabbit-dead-letter-exchange",
+		Desc:   "exchange where failed notifications are sent, they are kept in the RABBIT_QUEUE.dead queue",
+		EnvVar: "GREMLIN_SYNC_RABBIT_DEAD_LETTER_EXCHANGE",
+	})
+	deadLetterList := app.Bool(cli.BoolOpt{
+		Name:   "dead-letter-list",
+		Value:  false,
+		Desc:   "print the notifications of the dead-letter queue and exit",
+		EnvVar: "GREMLIN_SYNC_DEAD_LETTER_LIST",
+	})
+	deadLetterReplay := app.Bool(cli.BoolOpt{
+		Name:   "dead-letter-replay",
+		Value:  false,
+		Desc:   "move the notifications of the dead-letter queue back to the queue and exit",
+		EnvVar: "GREMLIN_SYNC_DEAD_LETTER_REPLAY",
+	})
+	httpAddr := app.String(cli.StringOpt{
+		Name:   "http",
+		Desc:   "host:port of the HTTP server for /healthz, /readyz and /metrics",
+		EnvVar: "GREMLIN_SYNC_HTTP",
+	})
+	maxPending := app.Int(cli.IntOpt{
+		Name:   "max-pending",
+		Value:  MaxPending,
+		Desc:   "number of pending notifications above which /healthz fails",
+		EnvVar: "GREMLIN_SYNC_MAX_PENDING",
+	})
+	events := app.Bool(cli.BoolOpt{
+		Name:   "events",
+		Value:  false,
+		Desc:   "stream the changes applied to the graph on /events",
+		EnvVar: "GREMLIN_SYNC_EVENTS",
+	})
+	webhooks := app.Strings(cli.StringsOpt{
+		Name:   "event-webhook",
+		Desc:   "URL where the changes applied to the graph are posted",
+		EnvVar: "GREMLIN_SYNC_EVENT_WEBHOOKS",
+	})
 	utils.SetupLogging(app, log)
 	app.Action = func() {
+		if *workers < 1 {
+			log.Fatal("--workers must be at least 1")
+		}
+		interval, err := time.ParseDuration(*reconcileInterval)
+		if err != nil || interval < 0 {
+			log.Fatalf("Invalid --reconcile-interval %s", *reconcileInterval)
+		}
+		if *events && *httpAddr == "" {
+			log.Fatal("--events requires --http to serve /events")
+		}
 		gremlinURI := fmt.Sprintf("ws://%s/gremlin", *gremlinSrv)
 		rabbitURI := fmt.Sprintf("amqp://%s:%s@%s/", *rabbitUser,
 			*rabbitPassword, *rabbitSrv)
-		setup(gremlinURI, *cassandraSrvs, rabbitURI, *rabbitVHost,
-			*rabbitQueue)
+		if *rabbitDeleteQueue {
+			if err := deleteRabbitQueue(rabbitURI, *rabbitVHost, *rabbitQueue); err != nil {
+				log.Fatalf("Failed to delete queue %s: %s", *rabbitQueue, err)
+			}
+			return
+		}
+		if *deadLetterList {
+			if err := listDeadLetters(rabbitURI, *rabbitVHost, *rabbitQueue); err != nil {
+				log.Fatalf("Failed to list dead-letter queue: %s", err)
+			}
+			return
+		}
+		if *deadLetterReplay {
+			if err := replayDeadLetters(rabbitURI, *rabbitVHost, *rabbitQueue); err != nil {
+				log.Fatalf("Failed to replay dead-letter queue: %s", err)
+			}
+			return
+		}
+		contrailAPIURL := fmt.Sprintf("http://%s", *contrailAPISrv)
+		if *replayPath != "" {
+			setupReplay(gremlinURI, *cluster, *source, *cassandraSrvs, contrailAPIURL,
+				*contrailAPIToken, *replayPath, *replayFast)
+			return
+		}
+		setup(gremlinURI, *cluster, *source, *cassandraSrvs, contrailAPIURL,
+			*contrailAPIToken, rabbitURI, *rabbitVHost, *rabbitQueue, *rabbitDurable, *journalPath, *recordPath, interval, *workers,
+			*maxRetries, *deadLetterExchange, *httpAddr, *maxPending, *events, *webhooks)
 	}
 	app.Run(os.Args)
 }
@@ -4,11 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
 	"github.com/eonpatapon/contrail-gremlin/testutils"
+	"github.com/eonpatapon/contrail-gremlin/utils"
 	"github.com/eonpatapon/gremlin"
 	uuid "github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
@@ -41,7 +48,7 @@ func TestSynchro(t *testing.T) {
 
 	msgs := make(chan amqp.Delivery)
 
-	sync := NewSync(session, msgs, gremlinURI)
+	sync := NewSync(utils.NewCassandraReader(session), msgs, gremlinURI)
 	go sync.synchronize()
 	sync.start()
 
@@ -80,7 +87,7 @@ func TestSynchroOrdering(t *testing.T) {
 
 	msgs := make(chan amqp.Delivery)
 
-	sync := NewSync(session, msgs, gremlinURI)
+	sync := NewSync(utils.NewCassandraReader(session), msgs, gremlinURI)
 	go sync.synchronize()
 	sync.start()
 
@@ -136,7 +143,7 @@ func TestDelete(t *testing.T) {
 
 	msgs := make(chan amqp.Delivery)
 
-	sync := NewSync(session, msgs, gremlinURI)
+	sync := NewSync(utils.NewCassandraReader(session), msgs, gremlinURI)
 	go sync.synchronize()
 	sync.start()
 
@@ -166,3 +173,473 @@ func TestDelete(t *testing.T) {
 
 	sync.stop()
 }
+
+func TestPlanReconcile(t *testing.T) {
+	unchanged, _ := uuid.NewV4()
+	modified, _ := uuid.NewV4()
+	added, _ := uuid.NewV4()
+	missing, _ := uuid.NewV4()
+	removed, _ := uuid.NewV4()
+	referenced, _ := uuid.NewV4()
+	unreferenced, _ := uuid.NewV4()
+	failed, _ := uuid.NewV4()
+
+	graph := map[uuid.UUID]graphVertex{
+		unchanged:    {ID: unchanged, Updated: 100},
+		modified:     {ID: modified, Updated: 100},
+		missing:      {ID: missing, Missing: 1},
+		removed:      {ID: removed, Updated: 100},
+		referenced:   {ID: referenced, Missing: 1, Edges: 1},
+		unreferenced: {ID: unreferenced, Missing: 1},
+		failed:       {ID: failed, Updated: 100},
+	}
+	lastModified := map[uuid.UUID]int64{
+		unchanged: 100,
+		modified:  200,
+	}
+	p := planReconcile(graph, []uuid.UUID{unchanged, modified, added, missing, failed}, 2,
+		func(id uuid.UUID) (int64, error) {
+			if id == failed {
+				return 0, errors.New("timeout")
+			}
+			return lastModified[id], nil
+		})
+
+	assert.ElementsMatch(t, []uuid.UUID{added, missing}, p.create)
+	assert.Equal(t, []uuid.UUID{modified}, p.update)
+	assert.ElementsMatch(t, []uuid.UUID{removed, unreferenced}, p.delete)
+	assert.Equal(t, 1, p.errors)
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gremlin-sync")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	notifications := []Notification{
+		{Oper: "CREATE", Type: "virtual_machine", UUID: id1},
+		{Oper: "UPDATE", Type: "virtual_machine", UUID: id1},
+		{Oper: "CREATE", Type: "virtual_network", UUID: id2},
+		{Oper: "UPDATE", Type: "virtual_machine", UUID: id1},
+		{Oper: "UPDATE", Type: "virtual_network", UUID: id2},
+		{Oper: "DELETE", Type: "virtual_network", UUID: id2},
+	}
+
+	sync := NewSync(nil, nil, gremlinURI)
+	assert.Nil(t, sync.EnableJournal(path))
+	for _, n := range notifications {
+		sync.handlePendingNotification(n)
+	}
+	sync.journal.close()
+	expected := []Notification{notifications[0], notifications[3], notifications[5]}
+	assert.Equal(t, expected, sync.pending)
+
+	// a crash can leave a partial line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"oper": "UPD`)
+	f.Close()
+
+	sync = NewSync(nil, nil, gremlinURI)
+	assert.Nil(t, sync.EnableJournal(path))
+	assert.Equal(t, expected, sync.pending)
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	assert.Nil(t, sync.journal.compact(sync.pending[1:]))
+	sync.journal.close()
+	_, pending, err := openJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[1:], pending)
+
+	// disconnected while processing the pending list
+	sync = NewSync(nil, nil, gremlinURI)
+	assert.Nil(t, sync.EnableJournal(path))
+	sync.processing, sync.pending = sync.pending, nil
+	n := Notification{Oper: "DELETE", Type: "virtual_machine", UUID: id1}
+	sync.handlePendingNotification(n)
+	assert.Equal(t, 3, sync.pendingCount())
+	sync.restorePendingNotifications()
+	sync.journal.close()
+	expected = []Notification{notifications[5], n}
+	assert.Equal(t, expected, sync.pending)
+	_, pending, err = openJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, pending)
+}
+
+func TestPartition(t *testing.T) {
+	id, _ := uuid.NewV4()
+	assert.Equal(t, partition(id, 4), partition(id, 4))
+	assert.Equal(t, 0, partition(id, 1))
+
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		id, _ := uuid.NewV4()
+		counts[partition(id, 4)]++
+	}
+	for _, c := range counts {
+		assert.True(t, c > 150, "unbalanced partitions %v", counts)
+	}
+}
+
+type recordAcknowledger struct {
+	acks     int
+	requeues int
+	rejects  int
+}
+
+func (a *recordAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *recordAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a.requeues++
+	} else {
+		a.rejects++
+	}
+	return nil
+}
+
+func (a *recordAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAck(t *testing.T) {
+	RetryDelay = 0
+	a := &recordAcknowledger{}
+	d := amqp.Delivery{Acknowledger: a, Body: []byte(`{"oper": "CREATE"}`)}
+	sync := NewSync(nil, nil, gremlinURI)
+	sync.SetMaxRetries(2)
+
+	sync.ack(d, nil)
+	sync.ack(d, utils.ErrResourceNotFound)
+	sync.ack(d, ErrPending)
+	assert.Equal(t, 3, a.acks)
+
+	// disconnected while the pending list is processed
+	for i := 0; i < 3; i++ {
+		sync.ack(d, gremlin.ErrConnectionClosed)
+	}
+	assert.Equal(t, 3, a.requeues)
+	assert.Equal(t, 0, a.rejects)
+	a.requeues = 0
+
+	sync.ack(d, ErrInvalidNotification)
+	assert.Equal(t, 1, a.rejects)
+	sync.ack(d, g.ErrClusterConflict)
+	assert.Equal(t, 2, a.rejects)
+
+	failure := errors.New("timeout")
+	sync.ack(d, failure)
+	sync.ack(d, failure)
+	assert.Equal(t, 2, a.requeues)
+	sync.ack(d, failure)
+	assert.Equal(t, 2, a.requeues)
+	assert.Equal(t, 3, a.rejects)
+
+	// retries are counted again after a success
+	sync.ack(d, failure)
+	sync.ack(d, nil)
+	sync.ack(d, failure)
+	sync.ack(d, failure)
+	assert.Equal(t, 5, a.requeues)
+	assert.Equal(t, 3, a.rejects)
+}
+
+func TestDeadLetterDeath(t *testing.T) {
+	now := time.Date(2018, 3, 5, 6, 21, 57, 0, time.UTC)
+	headers := amqp.Table{"x-death": []interface{}{
+		amqp.Table{"reason": "rejected", "time": now, "queue": "gremlin_sync"},
+		amqp.Table{"reason": "expired", "time": now.Add(-time.Hour)},
+	}}
+	d, reason := deadLetterDeath(headers)
+	assert.Equal(t, now, d)
+	assert.Equal(t, "rejected", reason)
+
+	d, reason = deadLetterDeath(amqp.Table{})
+	assert.True(t, d.IsZero())
+	assert.Equal(t, "unknown", reason)
+}
+
+func TestHealth(t *testing.T) {
+	sync := NewSync(nil, nil, gremlinURI)
+	rabbit := true
+	h := &healthServer{
+		sync:       sync,
+		rabbit:     func() bool { return rabbit },
+		maxPending: 1,
+	}
+	server := httptest.NewServer(h.handler())
+	defer server.Close()
+
+	get := func(path string) (int, Health) {
+		var health Health
+		r, err := http.Get(server.URL + path)
+		assert.Nil(t, err)
+		defer r.Body.Close()
+		json.NewDecoder(r.Body).Decode(&health)
+		return r.StatusCode, health
+	}
+
+	// not connected to gremlin server yet
+	code, health := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "connected", health.Rabbit)
+	assert.Equal(t, "unused", health.Cassandra)
+	assert.Equal(t, "disconnected", health.Gremlin)
+	assert.Nil(t, health.LastProcessed)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	sync.handlePendingNotification(Notification{Oper: "CREATE", UUID: id1})
+	sync.handlePendingNotification(Notification{Oper: "CREATE", UUID: id2})
+	sync.lastProcessed.Store(time.Now())
+	code, health = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 2, health.Pending)
+	assert.NotNil(t, health.LastProcessed)
+
+	h.maxPending = 10
+	rabbit = false
+	code, health = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "disconnected", health.Rabbit)
+}
+
+func TestMetrics(t *testing.T) {
+	sync := NewSync(nil, nil, gremlinURI)
+	server := httptest.NewServer((&healthServer{sync: sync}).handler())
+	defer server.Close()
+
+	id, _ := uuid.NewV4()
+	n := Notification{Oper: "CREATE", Type: "virtual_network", UUID: id}
+	sync.metrics.received.inc(n.Oper, n.Type)
+	sync.metrics.received.inc(n.Oper, n.Type)
+	sync.applied(n, time.Now().Add(-15*time.Millisecond))
+	sync.handleNotificationError(n, utils.ErrResourceNotFound, "read")
+	sync.handleNotificationError(n, errors.New("failed"), "write")
+	sync.handlePendingNotification(n)
+
+	v := g.Vertex{ID: id}
+	lastModified := time.Now().UTC().Add(-3 * time.Second).Format("2006-01-02T15:04:05.000000")
+	v.AddProperty("id_perms", map[string]interface{}{"last_modified": lastModified})
+	sync.metrics.observeLag(v)
+
+	r, err := http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	defer r.Body.Close()
+	data, _ := ioutil.ReadAll(r.Body)
+	metrics := string(data)
+
+	for _, line := range []string{
+		`gremlin_sync_notifications_received_total{oper="CREATE",type="virtual_network"} 2`,
+		`gremlin_sync_notifications_applied_total{oper="CREATE",type="virtual_network"} 1`,
+		`gremlin_sync_notification_failures_total{reason="not_found"} 1`,
+		`gremlin_sync_notification_failures_total{reason="write"} 1`,
+		`gremlin_sync_notification_duration_seconds_bucket{le="0.01"} 0`,
+		`gremlin_sync_notification_duration_seconds_bucket{le="0.025"} 1`,
+		`gremlin_sync_notification_duration_seconds_count 1`,
+		`gremlin_sync_lag_seconds_bucket{le="2.5"} 0`,
+		`gremlin_sync_lag_seconds_bucket{le="5"} 1`,
+		`gremlin_sync_lag_seconds_bucket{le="+Inf"} 1`,
+		`gremlin_sync_pending_notifications 1`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gremlin-sync-record")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "record.jsonl")
+
+	r, err := openRecorder(path)
+	assert.Nil(t, err)
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	start := time.Now()
+	notifications := []Notification{
+		{Oper: "CREATE", Type: "virtual_network", UUID: id1},
+		{Oper: "UPDATE", Type: "virtual_network", UUID: id1},
+		{Oper: "DELETE", Type: "project", UUID: id2},
+	}
+	for i, n := range notifications {
+		r.record(n, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	r.close()
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("{\"time\":\n")
+	f.Close()
+
+	handled := []Notification{}
+	handle := func(n Notification) error {
+		handled = append(handled, n)
+		if n.Oper == "DELETE" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	f, _ = os.Open(path)
+	result, err := replay(f, false, handle)
+	f.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, notifications, handled)
+	assert.Equal(t, 3, result.Replayed)
+	assert.Equal(t, 1, result.Failed)
+	assert.True(t, result.Duration >= 200*time.Millisecond)
+
+	handled = []Notification{}
+	f, _ = os.Open(path)
+	result, err = replay(f, true, handle)
+	f.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, notifications, handled)
+	assert.True(t, result.Duration < 100*time.Millisecond)
+}
+
+func TestEventStream(t *testing.T) {
+	s := newEventStream(2)
+	id, _ := uuid.NewV4()
+	s.publish(Event{Kind: VertexCreated, UUID: id})
+	s.publish(Event{Kind: VertexUpdated, UUID: id})
+	s.publish(Event{Kind: VertexDeleted, UUID: id})
+
+	// the first event is not in the history anymore
+	backlog, ch, err := s.subscribe(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(backlog))
+	assert.Equal(t, uint64(2), backlog[0].Seq)
+	assert.Equal(t, VertexUpdated, backlog[0].Kind)
+	backlog2, ch2, err := s.subscribe(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backlog2))
+	assert.Equal(t, uint64(3), backlog2[0].Seq)
+	_, _, err = s.subscribe(1)
+	assert.Nil(t, err)
+	_, _, err = s.subscribe(4)
+	assert.Equal(t, ErrUnknownEvent, err)
+
+	s.publish(Event{Kind: EdgeAdded, UUID: id})
+	e := <-ch
+	assert.Equal(t, uint64(4), e.Seq)
+	assert.Equal(t, EdgeAdded, e.Kind)
+	_, _, err = s.subscribe(1)
+	assert.Equal(t, ErrEventsLost, err)
+
+	// a subscriber that doesn't keep up is closed
+	for i := 0; i <= EventBuffer; i++ {
+		s.publish(Event{Kind: VertexUpdated, UUID: id})
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	assert.Equal(t, EventBuffer, count)
+	s.unsubscribe(ch)
+	s.unsubscribe(ch2)
+}
+
+func TestServeEvents(t *testing.T) {
+	s := newEventStream(EventHistory)
+	server := httptest.NewServer(http.HandlerFunc(s.serveEvents))
+	defer server.Close()
+
+	id, _ := uuid.NewV4()
+	s.publish(Event{Kind: VertexCreated, Type: "virtual_network", UUID: id,
+		FQName: []string{"default-domain", "admin", "vn"}})
+	s.publish(Event{Kind: VertexUpdated, Type: "virtual_network", UUID: id,
+		FQName: []string{"default-domain", "admin", "vn"}, Fields: []string{"display_name"}})
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d-1", s.epoch))
+	r, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer r.Body.Close()
+	assert.Equal(t, "text/event-stream", r.Header.Get("Content-Type"))
+
+	buf := make([]byte, 4096)
+	n, _ := r.Body.Read(buf)
+	lines := strings.Split(string(buf[:n]), "\n")
+	assert.Equal(t, fmt.Sprintf("id: %d-2", s.epoch), lines[0])
+	assert.Equal(t, "event: vertex_updated", lines[1])
+	e := Event{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e))
+	assert.Equal(t, id, e.UUID)
+	assert.Equal(t, []string{"display_name"}, e.Fields)
+	assert.Equal(t, []string{"default-domain", "admin", "vn"}, e.FQName)
+
+	r, err = http.Get(server.URL + "?since=foo")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	// events of a previous gremlin-sync process
+	r, err = http.Get(server.URL + fmt.Sprintf("?since=%d-1", s.epoch-1))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGone, r.StatusCode)
+	r, err = http.Get(server.URL + fmt.Sprintf("?since=%d-3", s.epoch))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGone, r.StatusCode)
+}
+
+func TestEventWebhook(t *testing.T) {
+	RetryDelay = 10 * time.Millisecond
+	received := make(chan Event, 10)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		e := Event{}
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer server.Close()
+
+	s := newEventStream(EventHistory)
+	id, _ := uuid.NewV4()
+	s.publish(Event{Kind: VertexCreated, UUID: id})
+	go s.deliver(server.URL)
+	s.publish(Event{Kind: VertexDeleted, UUID: id})
+
+	for _, kind := range []string{VertexCreated, VertexDeleted} {
+		select {
+		case e := <-received:
+			assert.Equal(t, kind, e.Kind)
+		case <-time.After(time.Second):
+			t.Fatalf("Event %s not delivered", kind)
+		}
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	old := map[string][]interface{}{
+		"fq_name":      {"default-domain", "admin", "vn"},
+		"display_name": {"vn"},
+		"updated":      {float64(1520230917)},
+		"id_perms":     {map[string]interface{}{"enable": true}},
+		"_incomplete":  {true},
+	}
+	v := g.Vertex{}
+	v.AddProperty("fq_name", "default-domain")
+	v.AddProperty("fq_name", "admin")
+	v.AddProperty("fq_name", "vn")
+	v.AddProperty("display_name", "vn2")
+	v.AddProperty("updated", int64(1520230917))
+	v.AddProperty("id_perms", map[string]interface{}{"enable": true})
+	v.AddProperty("router_external", false)
+	assert.Equal(t, []string{"_incomplete", "display_name", "router_external"},
+		changedFields(old, v.Properties))
+	assert.Equal(t, []string{"default-domain", "admin", "vn"}, vertexFQName(v))
+	assert.Equal(t, []string{"default-domain", "admin", "vn"}, fqName(old["fq_name"]))
+}
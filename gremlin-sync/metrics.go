@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+var (
+	// DurationBuckets are the buckets in seconds of the
+	// processing time of notifications
+	DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// LagBuckets are the buckets in seconds of the time between
+	// the modification of a resource and its update in the graph
+	LagBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// counterVec is a counter with labels in the prometheus text format
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	sync.Mutex
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelsString(c.labels, values)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatFloat(c.values[k]))
+	}
+}
+
+// histogram is a histogram in the prometheus text format
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	sync.Mutex
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func labelsString(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// syncMetrics are the metrics of the sync process
+type syncMetrics struct {
+	received *counterVec
+	applied  *counterVec
+	failures *counterVec
+	duration *histogram
+	lag      *histogram
+}
+
+func newSyncMetrics() *syncMetrics {
+	return &syncMetrics{
+		received: newCounterVec("gremlin_sync_notifications_received_total",
+			"Notifications received from rabbitmq.", "oper", "type"),
+		applied: newCounterVec("gremlin_sync_notifications_applied_total",
+			"Notifications applied to the graph.", "oper", "type"),
+		failures: newCounterVec("gremlin_sync_notification_failures_total",
+			"Notifications that failed to be applied.", "reason"),
+		duration: newHistogram("gremlin_sync_notification_duration_seconds",
+			"Processing time of notifications.", DurationBuckets),
+		lag: newHistogram("gremlin_sync_lag_seconds",
+			"Time between the last modification of a resource and its update in the graph.", LagBuckets),
+	}
+}
+
+// observeLag records the time since the id_perms.last_modified
+// of a resource that has just been written in the graph
+func (m *syncMetrics) observeLag(v g.Vertex) {
+	value, ok := v.PropertyValue("id_perms.last_modified")
+	if !ok {
+		return
+	}
+	s, ok := value.(string)
+	if !ok {
+		return
+	}
+	lastModified, err := time.Parse(time.RFC3339Nano, s+`Z`)
+	if err != nil {
+		return
+	}
+	lag := time.Since(lastModified).Seconds()
+	if lag < 0 {
+		lag = 0
+	}
+	m.lag.observe(lag)
+}
+
+func (s *Sync) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.received.write(w)
+	s.metrics.applied.write(w)
+	s.metrics.failures.write(w)
+	s.metrics.duration.write(w)
+	s.metrics.lag.write(w)
+	writeGauge(w, "gremlin_sync_pending_notifications",
+		"Notifications received while gremlin server is not connected.", float64(s.pendingCount()))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/eonpatapon/gremlin"
+	"github.com/satori/go.uuid"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+const (
+	// ReconcileReaders is the number of resources whose last
+	// modification is read in parallel during a reconciliation
+	ReconcileReaders = 10
+)
+
+var (
+	// ErrNotConnected indicates the reconciliation can't
+	// run because gremlin-server is not connected
+	ErrNotConnected = errors.New("not connected to gremlin server")
+)
+
+// ReconcileResult is the drift corrected by a reconciliation
+type ReconcileResult struct {
+	Created  int
+	Updated  int
+	Deleted  int
+	Errors   int
+	Duration time.Duration
+}
+
+// graphVertex is the state of a vertex in the graph
+type graphVertex struct {
+	ID      uuid.UUID `json:"id"`
+	Updated int64     `json:"updated"`
+	Missing int       `json:"missing"`
+	Edges   int       `json:"edges"`
+}
+
+type reconcilePlan struct {
+	create []uuid.UUID
+	update []uuid.UUID
+	delete []uuid.UUID
+	errors int
+}
+
+// lastModification is the last modification
+// of a resource read from the DB
+type lastModification struct {
+	id      uuid.UUID
+	updated int64
+	err     error
+}
+
+// planReconcile compares the vertices of the graph with the uuids of
+// the DB. Resources missing from the graph, or only present as
+// _missing vertices, are created. Resources modified since their
+// vertex was updated are updated. Vertices without resource are
+// deleted, except _missing vertices that are still referenced.
+// lastModified is called by readers goroutines.
+func planReconcile(graph map[uuid.UUID]graphVertex, uuids []uuid.UUID, readers int, lastModified func(uuid.UUID) (int64, error)) reconcilePlan {
+	p := reconcilePlan{}
+	found := make(map[uuid.UUID]bool, len(uuids))
+	ids := make(chan uuid.UUID)
+	modifications := make(chan lastModification)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < readers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				updated, err := lastModified(id)
+				modifications <- lastModification{id: id, updated: updated, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, id := range uuids {
+			if found[id] {
+				continue
+			}
+			found[id] = true
+			v, ok := graph[id]
+			if !ok || v.Missing > 0 {
+				p.create = append(p.create, id)
+				continue
+			}
+			ids <- id
+		}
+		close(ids)
+		wg.Wait()
+		close(modifications)
+	}()
+	for m := range modifications {
+		switch m.err {
+		case nil:
+			if m.updated > graph[m.id].Updated {
+				p.update = append(p.update, m.id)
+			}
+		// deleted since the uuids were listed
+		case utils.ErrResourceNotFound:
+		default:
+			log.Errorf("Failed to read last modification of %s: %s", m.id, m.err)
+			p.errors++
+		}
+	}
+	for id, v := range graph {
+		if !found[id] && (v.Missing == 0 || v.Edges == 0) {
+			p.delete = append(p.delete, id)
+		}
+	}
+	return p
+}
+
+// graphVertices lists the vertices of the graph, only
+// those of the cluster of the sync process if it has one
+func (s *Sync) graphVertices() (map[uuid.UUID]graphVertex, error) {
+	bindings := gremlin.Bind{}
+	data, err := s.backend.Send(gremlin.Query(`g.V()` + s.backend.InCluster(bindings) + `.project('id', 'updated', 'missing', 'edges')
+		.by(id)
+		.by(coalesce(values('updated'), constant(0)))
+		.by(properties('_missing').count())
+		.by(bothE().limit(1).count())`).Bindings(bindings))
+	if err != nil {
+		return nil, err
+	}
+	var vertices []graphVertex
+	if err := json.Unmarshal(data, &vertices); err != nil {
+		return nil, err
+	}
+	graph := make(map[uuid.UUID]graphVertex, len(vertices))
+	for _, v := range vertices {
+		graph[v.ID] = v
+	}
+	return graph, nil
+}
+
+// reconcile creates, updates or deletes vertices so that the
+// graph matches the DB. Notifications missed while the queue
+// expired or while gremlin-sync was down are caught up this way.
+func (s *Sync) reconcile(session gockle.Session) (ReconcileResult, error) {
+	result := ReconcileResult{}
+	if !s.backend.Connected() {
+		return result, ErrNotConnected
+	}
+	start := time.Now()
+	graph, err := s.graphVertices()
+	if err != nil {
+		return result, err
+	}
+
+	uuids := make([]uuid.UUID, 0)
+	ids := make(chan uuid.UUID)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- utils.GetContrailUUIDs(session, ids)
+		close(ids)
+	}()
+	for id := range ids {
+		uuids = append(uuids, id)
+	}
+	if err := <-errs; err != nil {
+		return result, err
+	}
+
+	p := planReconcile(graph, uuids, ReconcileReaders, func(id uuid.UUID) (int64, error) {
+		return utils.GetContrailLastModified(session, id)
+	})
+	result.Errors = p.errors
+	for _, id := range p.create {
+		if s.reconcileVertex(id, &result) {
+			result.Created++
+		}
+	}
+	for _, id := range p.update {
+		if s.reconcileVertex(id, &result) {
+			result.Updated++
+		}
+	}
+	for _, id := range p.delete {
+		if s.reconcileDelete(id, &result) {
+			result.Deleted++
+		}
+	}
+	result.Duration = time.Now().Sub(start)
+	return result, nil
+}
+
+// reconcileVertex writes the resource in the graph. Like the delete
+// below, it holds the lock of the resource so that a notification
+// processed meanwhile is not overwritten by an older version.
+func (s *Sync) reconcileVertex(id uuid.UUID, result *ReconcileResult) bool {
+	defer s.lockResource(id)()
+	vertex, err := s.reader.GetResource(id)
+	if err == utils.ErrResourceNotFound {
+		return false
+	}
+	if err == nil {
+		err = s.writeVertex(vertex)
+	}
+	if err != nil {
+		log.Errorf("Failed to reconcile resource %s: %s", id, err)
+		result.Errors++
+		return false
+	}
+	return true
+}
+
+func (s *Sync) reconcileDelete(id uuid.UUID, result *ReconcileResult) bool {
+	defer s.lockResource(id)()
+	// the resource may have been created since the uuids were listed
+	_, err := s.reader.GetResource(id)
+	switch err {
+	case utils.ErrResourceNotFound:
+		if err := s.dropVertex(g.Vertex{ID: id}); err != nil {
+			log.Errorf("Failed to delete vertex %s: %s", id, err)
+			result.Errors++
+			return false
+		}
+		return true
+	case nil:
+	default:
+		log.Errorf("Failed to read resource %s: %s", id, err)
+		result.Errors++
+	}
+	return false
+}
+
+// reconcileEvery reconciles the graph when gremlin-sync starts
+// and then at each interval
+func (s *Sync) reconcileEvery(session gockle.Session, interval time.Duration) {
+	for {
+		for !s.backend.Connected() {
+			time.Sleep(time.Second)
+		}
+		log.Notice("Reconciling graph with the DB...")
+		r, err := s.reconcile(session)
+		if err != nil {
+			log.Errorf("Reconciliation failed: %s", err)
+		} else {
+			log.Noticef("Reconciliation done in %0.2fs: %d created, %d updated, %d deleted, %d errors",
+				r.Duration.Seconds(), r.Created, r.Updated, r.Deleted, r.Errors)
+		}
+		time.Sleep(interval)
+	}
+}
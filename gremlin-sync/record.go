@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedNotification is a notification of a recording
+// with the time it was received
+type RecordedNotification struct {
+	Time time.Time `json:"time"`
+	Notification
+}
+
+// ReplayResult is the outcome of the replay of a recording
+type ReplayResult struct {
+	Replayed int
+	Failed   int
+	Duration time.Duration
+}
+
+// recorder appends the received notifications to a JSONL file
+type recorder struct {
+	f *os.File
+	sync.Mutex
+}
+
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f}, nil
+}
+
+func (r *recorder) record(n Notification, t time.Time) error {
+	r.Lock()
+	defer r.Unlock()
+	data, err := json.Marshal(RecordedNotification{Time: t, Notification: n})
+	if err != nil {
+		return err
+	}
+	_, err = r.f.Write(append(data, '\n'))
+	return err
+}
+
+func (r *recorder) close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
+
+// EnableRecord records the received notifications in the file at path
+func (s *Sync) EnableRecord(path string) error {
+	r, err := openRecorder(path)
+	if err != nil {
+		return err
+	}
+	s.recorder = r
+	return nil
+}
+
+// replay calls handle for each notification of a recording. Unless
+// fast is set, notifications are replayed at their original pace.
+func replay(r io.Reader, fast bool, handle func(Notification) error) (ReplayResult, error) {
+	result := ReplayResult{}
+	start := time.Now()
+	var first time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rn := RecordedNotification{}
+		if err := json.Unmarshal(scanner.Bytes(), &rn); err != nil {
+			log.Warningf("Skipping invalid recording line: %s", scanner.Text())
+			continue
+		}
+		if !fast {
+			if first.IsZero() {
+				first = rn.Time
+			}
+			// wait until the same time has elapsed since
+			// the first notification as in the recording
+			time.Sleep(rn.Time.Sub(first) - time.Now().Sub(start))
+		}
+		if err := handle(rn.Notification); err != nil {
+			result.Failed++
+		}
+		result.Replayed++
+	}
+	result.Duration = time.Now().Sub(start)
+	return result, scanner.Err()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	logging "github.com/op/go-logging"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/eonpatapon/contrail-gremlin/utils"
+)
+
+var (
+	log = logging.MustGetLogger("gremlin-validate")
+)
+
+func main() {
+	app := cli.App(os.Args[0], "Check the integrity of a GraphSON file")
+	filePath := app.String(cli.StringArg{
+		Name: "SRC",
+		Desc: "GraphSON file path",
+	})
+	utils.SetupLogging(app, log)
+	app.Action = func() {
+		f, err := os.Open(*filePath)
+		if err != nil {
+			log.Fatalf("Failed to open file %s: %s", *filePath, err)
+		}
+		defer f.Close()
+
+		result, err := g.ValidateGson(f)
+		if err != nil {
+			log.Fatalf("Failed to read file %s: %s", *filePath, err)
+		}
+		for _, e := range result.Errors {
+			fmt.Printf("%s:%s\n", *filePath, e)
+		}
+		log.Noticef("%d vertices, %d edges, %d errors",
+			result.Vertices, result.Edges, len(result.Errors))
+		if len(result.Errors) > 0 {
+			cli.Exit(1)
+		}
+	}
+	app.Run(os.Args)
+}
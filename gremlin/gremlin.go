@@ -93,6 +93,18 @@ func findValue(path []string, data interface{}) (interface{}, bool) {
 	}
 }
 
+// WithProperty returns a copy of the vertex with the single
+// property name set, the properties of v are not modified
+func (v Vertex) WithProperty(name string, value interface{}) Vertex {
+	props := make(map[string][]Property, len(v.Properties)+1)
+	for k, p := range v.Properties {
+		props[k] = p
+	}
+	v.Properties = props
+	v.AddSingleProperty(name, value)
+	return v
+}
+
 func (v *Vertex) HasProp(name string) bool {
 	if _, ok := v.Properties[name]; ok {
 		return true
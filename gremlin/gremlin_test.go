@@ -30,3 +30,17 @@ func TestAddProperty(t *testing.T) {
 	assert.Equal(t, expectedProps, v.Properties, "")
 
 }
+
+func TestWithProperty(t *testing.T) {
+	id, _ := uuid.NewV4()
+	v := Vertex{
+		ID:    id,
+		Label: "foo",
+	}
+	v.AddProperty("prop1", 1)
+
+	v2 := v.WithProperty("cluster", "region1")
+	assert.Equal(t, []Property{{Value: "region1"}}, v2.Properties["cluster"])
+	assert.Equal(t, []Property{{Value: 1}}, v2.Properties["prop1"])
+	assert.False(t, v.HasProp("cluster"))
+}
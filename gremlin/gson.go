@@ -1,6 +1,7 @@
 package gremlin
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"io"
@@ -120,20 +121,119 @@ func (v GsonVertex) UUID() uuid.UUID {
 	return v.ID.Value.(uuid.UUID)
 }
 
+// ReadGsonVertex parses a vertex line of a GraphSON file
+func ReadGsonVertex(data []byte) (Vertex, error) {
+	gv := GsonVertex{}
+	if err := gv.fromJSON(data); err != nil {
+		return Vertex{}, err
+	}
+	return gv.toVertex(), nil
+}
+
+// toVertex converts back a GSON vertex. The labels of the
+// vertices at the other end of the edges are not known.
+func (v GsonVertex) toVertex() Vertex {
+	vertex := Vertex{
+		ID:    v.UUID(),
+		Label: v.Label,
+	}
+	for name, props := range v.Properties {
+		for _, p := range props {
+			vertex.AddProperty(name, fromGsonValue(p.Value))
+		}
+	}
+	for label, edges := range v.InE {
+		for _, e := range edges {
+			vertex.AddInEdge(e.toEdge(label))
+		}
+	}
+	for label, edges := range v.OutE {
+		for _, e := range edges {
+			vertex.AddOutEdge(e.toEdge(label))
+		}
+	}
+	return vertex
+}
+
+func (e GsonEdge) toEdge(label string) Edge {
+	edge := Edge{Label: label}
+	if e.OutV != nil {
+		edge.OutV = e.OutV.Value.(uuid.UUID)
+	}
+	if e.InV != nil {
+		edge.InV = e.InV.Value.(uuid.UUID)
+	}
+	for name, value := range e.Properties {
+		edge.AddProperty(name, fromGsonValue(value))
+	}
+	return edge
+}
+
+// fromGsonValue converts a GSON typed value to
+// the value it was built from
+func fromGsonValue(value interface{}) interface{} {
+	switch value.(type) {
+	case GsonValue:
+		v := value.(GsonValue)
+		switch v.Type {
+		case "g:List":
+			list := make([]interface{}, 0)
+			for _, item := range v.Value.([]interface{}) {
+				list = append(list, fromGsonValue(item))
+			}
+			return list
+		case "g:Map":
+			items := v.Value.([]interface{})
+			m := make(map[string]interface{})
+			for i := 0; i+1 < len(items); i += 2 {
+				m[items[i].(string)] = fromGsonValue(items[i+1])
+			}
+			return m
+		default:
+			return v.Value
+		}
+	case map[string]interface{}:
+		v := GsonValue{}
+		if _, ok := value.(map[string]interface{})["@type"]; !ok {
+			return value
+		}
+		if err := v.fill(value.(map[string]interface{})); err != nil {
+			return value
+		}
+		return fromGsonValue(v)
+	default:
+		return value
+	}
+}
+
 type WriteAction struct {
 	vertex Vertex
 	result chan error
 }
 
+// GsonCheckpoint records the state of a GSON file being written.
+// Vertices are complete up to Offset. Pending holds the labels of
+// the vertices that are referenced but not written yet.
+type GsonCheckpoint struct {
+	Offset   int64                `json:"offset"`
+	Vertices int                  `json:"vertices"`
+	Pending  map[uuid.UUID]string `json:"pending"`
+}
+
 type GsonBackend struct {
-	output  io.Writer
-	write   chan WriteAction
-	written map[uuid.UUID]bool
-	pending map[uuid.UUID]Vertex
-	propID  *int64           // property ID counter
-	edgeID  *int64           // edge ID counter
-	edgeIDs map[string]int64 // track edge IDs
-	wg      *sync.WaitGroup
+	output     io.Writer
+	write      chan WriteAction
+	written    map[uuid.UUID]bool
+	pending    map[uuid.UUID]Vertex
+	propID     *int64           // property ID counter
+	edgeID     *int64           // edge ID counter
+	edgeIDs    map[string]int64 // track edge IDs
+	offset     int64            // bytes written to output
+	missing    map[string]int   // missing vertices written per type
+	mergeEdges bool             // merge the edges of pending vertices
+	checkpoint func(GsonCheckpoint)
+	every      int
+	wg         *sync.WaitGroup
 	sync.RWMutex
 }
 
@@ -146,10 +246,118 @@ func NewGsonBackend(output io.Writer) *GsonBackend {
 		propID:  new(int64),
 		edgeID:  new(int64),
 		edgeIDs: make(map[string]int64),
+		missing: make(map[string]int),
 		wg:      &sync.WaitGroup{},
 	}
 }
 
+// SetCheckpoint calls fn every n vertices written with
+// the state of the output. It must be called before Start.
+func (b *GsonBackend) SetCheckpoint(n int, fn func(GsonCheckpoint)) {
+	b.every = n
+	b.checkpoint = fn
+}
+
+// SetMergePendingEdges adds to each vertex the edges that vertices
+// written before have with it, when the vertex doesn't have them
+// itself. By default vertices are written with their own edges only.
+// It must be called before Start.
+func (b *GsonBackend) SetMergePendingEdges(merge bool) {
+	b.mergeEdges = merge
+}
+
+func (b *GsonBackend) newCheckpoint() GsonCheckpoint {
+	c := GsonCheckpoint{
+		Offset:   b.offset,
+		Vertices: len(b.written),
+		Pending:  make(map[uuid.UUID]string, len(b.pending)),
+	}
+	for id, v := range b.pending {
+		c.Pending[id] = v.Label
+	}
+	return c
+}
+
+// Resume restores the state of the backend from the vertices already
+// written to a GSON file, up to the checkpoint offset. New vertices
+// are then appended to the output. It returns the IDs of the vertices
+// read and must be called before Start.
+func (b *GsonBackend) Resume(input io.Reader, c GsonCheckpoint) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, 0)
+	r := bufio.NewReader(io.LimitReader(input, c.Offset))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			gv := GsonVertex{}
+			if err := gv.fromJSON(line); err != nil {
+				return nil, err
+			}
+			b.resumeIDs(gv)
+			v := gv.toVertex()
+			for _, edges := range v.OutE {
+				for i := range edges {
+					edges[i].InVLabel = c.Pending[edges[i].InV]
+				}
+			}
+			for _, edges := range v.InE {
+				for i := range edges {
+					edges[i].OutVLabel = c.Pending[edges[i].OutV]
+				}
+			}
+			b.addPendingV(v)
+			delete(b.pending, v.ID)
+			b.written[v.ID] = true
+			ids = append(ids, v.ID)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.offset = c.Offset
+	return ids, nil
+}
+
+// resumeIDs restores the property and edge ID counters
+// so that new IDs don't collide with the written ones
+func (b *GsonBackend) resumeIDs(gv GsonVertex) {
+	for _, props := range gv.Properties {
+		for _, p := range props {
+			if id, ok := p.ID.Value.(int64); ok && id > *b.propID {
+				*b.propID = id
+			}
+		}
+	}
+	resume := func(ref string, e GsonEdge) {
+		if id, ok := e.ID.Value.(int64); ok {
+			b.edgeIDs[ref] = id
+			if id > *b.edgeID {
+				*b.edgeID = id
+			}
+		}
+	}
+	for _, edges := range gv.InE {
+		for _, e := range edges {
+			outV := gv.UUID()
+			if e.OutV != nil {
+				outV = e.OutV.Value.(uuid.UUID)
+			}
+			resume(outV.String()+"-"+gv.UUID().String(), e)
+		}
+	}
+	for _, edges := range gv.OutE {
+		for _, e := range edges {
+			inV := gv.UUID()
+			if e.InV != nil {
+				inV = e.InV.Value.(uuid.UUID)
+			}
+			resume(gv.UUID().String()+"-"+inV.String(), e)
+		}
+	}
+}
+
 func (b *GsonBackend) Start() {
 	go b.writer()
 }
@@ -162,7 +370,9 @@ func (b *GsonBackend) Stop() {
 func (b *GsonBackend) addPendingV(v Vertex) {
 	// First we check that for each edge of the vertex
 	// we already have written the other vertex
-	// if not we add the other vertex to a pending map
+	// if not we add the other vertex to a pending map.
+	// The pending vertex belongs to the cluster of v.
+	cluster, hasCluster := v.Properties["cluster"]
 
 	// ref, parent
 	for label, edges := range v.OutE {
@@ -181,6 +391,9 @@ func (b *GsonBackend) addPendingV(v Vertex) {
 				}
 				pendingV.AddSingleProperty("fq_name", []string{"_missing"})
 				pendingV.AddSingleProperty("_missing", true)
+				if hasCluster {
+					pendingV.Properties["cluster"] = cluster
+				}
 				b.pending[pendingV.ID] = pendingV
 			}
 			pendingV.AddInEdge(Edge{
@@ -208,6 +421,9 @@ func (b *GsonBackend) addPendingV(v Vertex) {
 				}
 				pendingV.AddProperty("fq_name", []string{"_missing"})
 				pendingV.AddProperty("_missing", true)
+				if hasCluster {
+					pendingV.Properties["cluster"] = cluster
+				}
 				b.pending[pendingV.ID] = pendingV
 			}
 			pendingV.AddOutEdge(Edge{
@@ -220,18 +436,72 @@ func (b *GsonBackend) addPendingV(v Vertex) {
 	}
 }
 
+// mergePendingEdges adds to v the edges that already written
+// vertices have with it, when v doesn't have them itself
+// (eg: a ref without the corresponding backref)
+func (b *GsonBackend) mergePendingEdges(v Vertex) Vertex {
+	pendingV, ok := b.pending[v.ID]
+	if !ok {
+		return v
+	}
+	for label, edges := range pendingV.InE {
+		for _, e := range edges {
+			if !hasEdgeWith(v.InE[label], e.OutV, func(e Edge) uuid.UUID { return e.OutV }) {
+				v.AddInEdge(e)
+			}
+		}
+	}
+	for label, edges := range pendingV.OutE {
+		for _, e := range edges {
+			if !hasEdgeWith(v.OutE[label], e.InV, func(e Edge) uuid.UUID { return e.InV }) {
+				v.AddOutEdge(e)
+			}
+		}
+	}
+	return v
+}
+
+func hasEdgeWith(edges []Edge, id uuid.UUID, other func(Edge) uuid.UUID) bool {
+	for _, e := range edges {
+		if other(e) == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *GsonBackend) writer() {
 	b.wg.Add(1)
 	defer b.wg.Done()
 	for a := range b.write {
+		if _, ok := b.written[a.vertex.ID]; ok {
+			a.result <- ErrDuplicateVertex
+			continue
+		}
 		b.addPendingV(a.vertex)
-		a.result <- b.writeVertex(a.vertex)
+		v := a.vertex
+		if b.mergeEdges {
+			v = b.mergePendingEdges(v)
+		}
+		err := b.writeVertex(v)
+		if err == nil && b.checkpoint != nil && len(b.written)%b.every == 0 {
+			b.checkpoint(b.newCheckpoint())
+		}
+		a.result <- err
 	}
 	for _, v := range b.pending {
-		b.writeVertex(v)
+		if b.writeVertex(v) == nil {
+			b.missing[v.Label]++
+		}
 	}
 }
 
+// Missing returns the number of vertices per type that were referenced
+// but never created, written as missing. It is only valid after Stop.
+func (b *GsonBackend) Missing() map[string]int {
+	return b.missing
+}
+
 func (b *GsonBackend) writeVertex(v Vertex) error {
 	if _, ok := b.written[v.ID]; ok {
 		return ErrDuplicateVertex
@@ -241,15 +511,15 @@ func (b *GsonBackend) writeVertex(v Vertex) error {
 	if err != nil {
 		return err
 	}
-	_, err = b.output.Write(vJSON)
+	_, err = b.output.Write(append(vJSON, '\n'))
 	if err != nil {
 		return err
 	}
+	b.offset += int64(len(vJSON) + 1)
 	b.written[gv.UUID()] = true
 	if _, ok := b.pending[v.ID]; ok {
 		delete(b.pending, v.ID)
 	}
-	b.output.Write([]byte("\n"))
 	return nil
 }
 
@@ -226,3 +226,137 @@ func TestJSON(t *testing.T) {
 
 	assert.Equal(t, gv1, gv2)
 }
+
+func TestPendingEdgesMerge(t *testing.T) {
+	var data []byte
+	buf := bytes.NewBuffer(data)
+	b := NewGsonBackend(buf)
+	b.SetMergePendingEdges(true)
+	b.Start()
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	v1.AddOutEdge(Edge{
+		Label:    "ref",
+		InV:      id2,
+		InVLabel: "bar",
+	})
+	// v2 has no backref to v1
+	v2 := Vertex{
+		ID:    id2,
+		Label: "bar",
+	}
+	b.Create(v1)
+	b.Create(v2)
+	b.Stop()
+
+	vJSON1, _ := buf.ReadBytes('\n')
+	vJSON2, _ := buf.ReadBytes('\n')
+	gv1 := GsonVertex{}
+	gv1.fromJSON(vJSON1)
+	gv2 := GsonVertex{}
+	gv2.fromJSON(vJSON2)
+
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, 1, len(gv2.InE["ref"]))
+	assert.Equal(t, id1, gv2.InE["ref"][0].OutV.Value.(uuid.UUID))
+	assert.Equal(t, gv1.OutE["ref"][0].ID.Value, gv2.InE["ref"][0].ID.Value)
+
+	// vertices are written with their own edges by default
+	buf.Reset()
+	b = NewGsonBackend(buf)
+	b.Start()
+	b.Create(v1)
+	b.Create(v2)
+	b.Stop()
+	buf.ReadBytes('\n')
+	vJSON2, _ = buf.ReadBytes('\n')
+	gv2 = GsonVertex{}
+	gv2.fromJSON(vJSON2)
+	assert.Equal(t, 0, len(gv2.InE["ref"]))
+}
+
+func TestReadGsonVertex(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	v1.AddProperty("prop1", int64(1))
+	v1.AddProperty("prop2", []interface{}{"a", map[string]interface{}{"b": 2.5}})
+	e1 := Edge{
+		Label: "ref",
+		InV:   id2,
+	}
+	e1.AddProperty("attr", map[string]interface{}{"c": "d"})
+	v1.AddOutEdge(e1)
+
+	_, w := io.Pipe()
+	b := NewGsonBackend(w)
+	gv1JSON, _ := b.newGsonVertex(v1).toJSON()
+
+	v2, err := ReadGsonVertex(gv1JSON)
+	assert.Nil(t, err)
+	assert.Equal(t, v1.ID, v2.ID)
+	assert.Equal(t, v1.Properties["prop1"][0].Value, v2.Properties["prop1"][0].Value)
+	assert.Equal(t, v1.Properties["prop2"], v2.Properties["prop2"])
+	assert.Equal(t, v1.OutE, v2.OutE)
+}
+
+func TestResume(t *testing.T) {
+	var data []byte
+	buf := bytes.NewBuffer(data)
+	b := NewGsonBackend(buf)
+	var checkpoint GsonCheckpoint
+	b.SetCheckpoint(1, func(c GsonCheckpoint) {
+		checkpoint = c
+	})
+	b.Start()
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	v1.AddProperty("prop1", 1)
+	v1.AddOutEdge(Edge{
+		Label:    "ref",
+		InV:      id2,
+		InVLabel: "bar",
+	})
+	b.Create(v1)
+	b.Stop()
+
+	assert.Equal(t, 1, checkpoint.Vertices)
+	assert.Equal(t, "bar", checkpoint.Pending[id2])
+
+	vJSON1, _ := buf.ReadBytes('\n')
+	gv1 := GsonVertex{}
+	gv1.fromJSON(vJSON1)
+	assert.Equal(t, int64(len(vJSON1)), checkpoint.Offset)
+
+	var output bytes.Buffer
+	b2 := NewGsonBackend(&output)
+	ids, err := b2.Resume(bytes.NewReader(vJSON1), checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, []uuid.UUID{id1}, ids)
+	b2.Start()
+	assert.Equal(t, ErrDuplicateVertex, b2.Create(v1))
+	b2.Stop()
+
+	vJSON2, _ := output.ReadBytes('\n')
+	gv2 := GsonVertex{}
+	gv2.fromJSON(vJSON2)
+	assert.Equal(t, 0, output.Len())
+	assert.Equal(t, id2, gv2.UUID())
+	assert.Equal(t, "bar", gv2.Label)
+	assert.Equal(t, 1, len(gv2.InE["ref"]))
+	assert.Equal(t, gv1.OutE["ref"][0].ID.Value, gv2.InE["ref"][0].ID.Value)
+	assert.True(t, gv2.Properties["fq_name"][0].ID.Value.(int64) > gv1.Properties["prop1"][0].ID.Value.(int64))
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/eonpatapon/gremlin"
 	"github.com/google/go-cmp/cmp"
 	logging "github.com/op/go-logging"
+	"github.com/satori/go.uuid"
 )
 
 var (
@@ -19,6 +20,9 @@ var (
 	// ErrIncompleteVertex indicates that the vertex is missing properties
 	// and will not be put in gremlin-server
 	ErrIncompleteVertex = errors.New("vertex is incomplete")
+	// ErrClusterConflict indicates that the vertex already
+	// exists in the graph for another cluster
+	ErrClusterConflict = errors.New("vertex belongs to another cluster")
 )
 
 // ServerBackend handles operations against gremlin-server
@@ -27,6 +31,7 @@ type ServerBackend struct {
 	connected            atomic.Value
 	connectedHandlers    []func()
 	disconnectedHandlers []func(error)
+	cluster              string
 }
 
 // NewServerBackend is the connection to the gremlin-server
@@ -70,6 +75,48 @@ func (b *ServerBackend) onDisconnected(err error) {
 	}
 }
 
+// SetCluster restricts the backend to the vertices of the cluster.
+// Vertices written by the backend get a cluster property and
+// vertices of other clusters are never modified.
+func (b *ServerBackend) SetCluster(cluster string) {
+	b.cluster = cluster
+}
+
+// Cluster returns the cluster of the backend
+func (b *ServerBackend) Cluster() string {
+	return b.cluster
+}
+
+// InCluster returns the step that filters the vertices of the
+// cluster of the backend and adds its binding to bindings
+func (b *ServerBackend) InCluster(bindings gremlin.Bind) string {
+	if b.cluster == "" {
+		return ""
+	}
+	bindings["_cluster"] = b.cluster
+	return `.has('cluster', _cluster)`
+}
+
+// claimable returns the step that filters the vertices of the
+// cluster of the backend and the _missing vertices without
+// cluster, eg: the placeholders of a dump, that the backend
+// can tag with its cluster
+func (b *ServerBackend) claimable(bindings gremlin.Bind) string {
+	if b.cluster == "" {
+		return ""
+	}
+	bindings["_cluster"] = b.cluster
+	return `.or(has('cluster', _cluster), has('_missing').hasNot('cluster'))`
+}
+
+func (b *ServerBackend) clusterProperty(bindings gremlin.Bind) string {
+	if b.cluster == "" {
+		return ""
+	}
+	bindings["_cluster"] = b.cluster
+	return `.property('cluster', _cluster)`
+}
+
 // Start starts the underlying client
 func (b *ServerBackend) Start() {
 	b.client.Connect()
@@ -101,14 +148,27 @@ func (b *ServerBackend) CreateVertex(v Vertex) error {
 	return b.UpdateVertex(v)
 }
 
-// CreateEdge create an edge between it's vertices
+// CreateEdge create an edge between it's vertices. It returns
+// ErrClusterConflict when the other vertex belongs to another cluster.
 func (b *ServerBackend) CreateEdge(e Edge) error {
+	if b.cluster != "" {
+		other := e.InV
+		if e.InVLabel == "" {
+			other = e.OutV
+		}
+		if err := b.checkCluster(Vertex{ID: other}); err != nil {
+			return err
+		}
+	}
 	props, bindings := edgePropertiesQuery(e.Properties)
 	bindings["_outv"] = e.OutV
 	bindings["_outv_label"] = e.OutVLabel
 	bindings["_inv"] = e.InV
 	bindings["_inv_label"] = e.InVLabel
 	bindings["_label"] = e.Label
+	inCluster := b.InCluster(bindings)
+	claimable := b.claimable(bindings)
+	clusterProperty := b.clusterProperty(bindings)
 
 	// make sure that the other side of the edge exists
 	// if it doesn't we create it with the _missing property
@@ -116,24 +176,24 @@ func (b *ServerBackend) CreateEdge(e Edge) error {
 	var query string
 	// for ref/parent
 	if e.OutVLabel == "" {
-		query = `g.V(_outv).as('outv').coalesce(
-			g.V(_inv),
+		query = `g.V(_outv)` + inCluster + `.as('outv').coalesce(
+			g.V(_inv)` + claimable + clusterProperty + `,
 			g.addV(_inv_label)
 			 .property(id, _inv)
 			 .property('fq_name', ['_missing'])
 			 .property('_missing', true)
-			 .property('deleted', 0)
+			 .property('deleted', 0)` + clusterProperty + `
 		).addE(_label).from('outv')` + props + `.iterate()`
 	}
 	// for children/backref
 	if e.InVLabel == "" {
-		query = `g.V(_inv).as('inv').coalesce(
-			g.V(_outv),
+		query = `g.V(_inv)` + inCluster + `.as('inv').coalesce(
+			g.V(_outv)` + claimable + clusterProperty + `,
 			g.addV(_outv_label)
 			 .property(id, _outv)
 			 .property('fq_name', ['_missing'])
 			 .property('_missing', true)
-			 .property('deleted', 0)
+			 .property('deleted', 0)` + clusterProperty + `
 		).addE(_label).to('inv')` + props + `.iterate()`
 	}
 
@@ -148,13 +208,26 @@ func (b *ServerBackend) CreateEdge(e Edge) error {
 
 // UpdateVertex updates properties and edges of the given vertex
 func (b *ServerBackend) UpdateVertex(v Vertex) error {
+	_, _, err := b.ApplyVertex(v)
+	return err
+}
+
+// ApplyVertex creates or updates the given vertex like UpdateVertex
+// and returns the edges that were added and removed
+func (b *ServerBackend) ApplyVertex(v Vertex) ([]Edge, []Edge, error) {
 	if v.Label == "" {
-		return ErrIncompleteVertex
+		return nil, nil, ErrIncompleteVertex
+	}
+	if b.cluster != "" {
+		if err := b.checkCluster(v); err != nil {
+			return nil, nil, err
+		}
+		v = v.WithProperty("cluster", b.cluster)
 	}
 	props, bindings := vertexPropertiesQuery(v.Properties)
 	bindings["_id"] = v.ID
 	bindings["_label"] = v.Label
-	query := `g.V().hasId(_id).fold().
+	query := `g.V().hasId(_id)` + b.claimable(bindings) + `.fold().
 			  coalesce(unfold().sideEffect(properties().drop()),
 					   addV(_label).property(id, _id))
 			 ` + props + `.iterate()`
@@ -165,17 +238,43 @@ func (b *ServerBackend) UpdateVertex(v Vertex) error {
 		if err == gremlin.ErrStatusInvalidRequestArguments {
 			log.Errorf("Query: %s, Bindings: %s", query, bindings)
 		}
-		return err
+		return nil, nil, err
 	}
 	return b.updateVertexEdges(v)
 }
 
+// checkCluster returns ErrClusterConflict when the vertex exists
+// in the graph for another cluster, or without cluster unless it
+// is a _missing vertex that can be claimed
+func (b *ServerBackend) checkCluster(v Vertex) error {
+	data, err := b.Send(
+		gremlin.Query(`g.V(_id).coalesce(values('cluster'), has('_missing').constant(_cluster), constant(''))`).Bindings(
+			gremlin.Bind{
+				"_id":      v.ID,
+				"_cluster": b.cluster,
+			},
+		),
+	)
+	if err != nil {
+		return err
+	}
+	var clusters []string
+	json.Unmarshal(data, &clusters)
+	for _, cluster := range clusters {
+		if cluster != b.cluster {
+			return ErrClusterConflict
+		}
+	}
+	return nil
+}
+
 // UpdateEdge updates properties of the given edge
 func (b *ServerBackend) UpdateEdge(e Edge) error {
 	props, bindings := edgePropertiesQuery(e.Properties)
 	bindings["_inv"] = e.InV
 	bindings["_outv"] = e.OutV
-	query := `g.V(_inv).bothE().where(otherV().hasId(_outv))
+	inCluster := b.InCluster(bindings)
+	query := `g.V(_inv)` + inCluster + `.bothE().where(otherV().hasId(_outv)` + inCluster + `)
 			   .sideEffect(properties().drop())` + props + `.iterate()`
 	_, err := b.Send(
 		gremlin.Query(query).Bindings(bindings),
@@ -188,12 +287,11 @@ func (b *ServerBackend) UpdateEdge(e Edge) error {
 
 // DeleteVertex deletes the given vertex
 func (b *ServerBackend) DeleteVertex(v Vertex) error {
+	bindings := gremlin.Bind{
+		"_id": v.ID,
+	}
 	_, err := b.Send(
-		gremlin.Query(`g.V(_id).drop()`).Bindings(
-			gremlin.Bind{
-				"_id": v.ID,
-			},
-		),
+		gremlin.Query(`g.V(_id)` + b.InCluster(bindings) + `.drop()`).Bindings(bindings),
 	)
 	if err != nil {
 		return err
@@ -203,29 +301,52 @@ func (b *ServerBackend) DeleteVertex(v Vertex) error {
 
 // DeleteEdge deletes the given edge
 func (b *ServerBackend) DeleteEdge(e Edge) error {
+	bindings := gremlin.Bind{
+		"_inv":  e.InV,
+		"_outv": e.OutV,
+	}
+	inCluster := b.InCluster(bindings)
 	_, err := b.Send(
-		gremlin.Query("g.V(_inv).bothE().where(otherV().hasId(_outv)).drop()").Bindings(
-			gremlin.Bind{
-				"_inv":  e.InV,
-				"_outv": e.OutV,
-			},
-		),
+		gremlin.Query(`g.V(_inv)` + inCluster + `.bothE().where(otherV().hasId(_outv)` + inCluster + `).drop()`).Bindings(bindings),
 	)
 	return err
 }
 
+// VertexProperties returns the properties of the vertex in
+// gremlin-server, or nil when the vertex doesn't exist
+func (b *ServerBackend) VertexProperties(id uuid.UUID) (map[string][]interface{}, error) {
+	bindings := gremlin.Bind{
+		"_id": id,
+	}
+	data, err := b.Send(
+		gremlin.Query(`g.V(_id)` + b.InCluster(bindings) + `.valueMap()`).Bindings(bindings),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var props []map[string][]interface{}
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, err
+	}
+	if len(props) == 0 {
+		return nil, nil
+	}
+	return props[0], nil
+}
+
 // UpdateVertexProperty set the given property on the vertex
 func (b *ServerBackend) UpdateVertexProperty(v Vertex, name string, value interface{}) error {
 	if v.Label == "" {
 		return ErrIncompleteVertex
 	}
-	query := `g.V(_id).property(_name, _value).iterate()`
+	bindings := gremlin.Bind{
+		"_id":    v.ID,
+		"_name":  name,
+		"_value": value,
+	}
+	query := `g.V(_id)` + b.InCluster(bindings) + `.property(_name, _value).iterate()`
 	_, err := b.Send(
-		gremlin.Query(query).Bindings(gremlin.Bind{
-			"_id":    v.ID,
-			"_name":  name,
-			"_value": value,
-		}),
+		gremlin.Query(query).Bindings(bindings),
 	)
 	if err != nil {
 		return err
@@ -235,12 +356,12 @@ func (b *ServerBackend) UpdateVertexProperty(v Vertex, name string, value interf
 
 func (b *ServerBackend) currentVertexEdges(v Vertex) (edges []Edge, err error) {
 	var data []byte
+	bindings := gremlin.Bind{
+		"_id": v.ID.String(),
+	}
+	inCluster := b.InCluster(bindings)
 	data, err = b.Send(
-		gremlin.Query(`g.V(_id).bothE()`).Bindings(
-			gremlin.Bind{
-				"_id": v.ID.String(),
-			},
-		),
+		gremlin.Query(`g.V(_id)` + inCluster + `.bothE().where(otherV()` + inCluster + `)`).Bindings(bindings),
 	)
 	if err != nil {
 		return nil, err
@@ -306,34 +427,34 @@ func (b *ServerBackend) diffVertexEdges(v Vertex) ([]Edge, []Edge, []Edge, error
 	return toAdd, toUpdate, toRemove, nil
 }
 
-func (b *ServerBackend) updateVertexEdges(v Vertex) error {
+func (b *ServerBackend) updateVertexEdges(v Vertex) ([]Edge, []Edge, error) {
 	toAdd, toUpdate, toRemove, err := b.diffVertexEdges(v)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	for _, edge := range toAdd {
 		err = b.CreateEdge(edge)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
 	for _, edge := range toUpdate {
 		err = b.UpdateEdge(edge)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
 	for _, edge := range toRemove {
 		err = b.DeleteEdge(edge)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	return nil
+	return toAdd, toRemove, nil
 }
 
 func vertexPropertiesQuery(propList map[string][]Property) (string, gremlin.Bind) {
@@ -252,3 +252,130 @@ func TestIndirectCreate(t *testing.T) {
 
 	b.Stop()
 }
+
+func TestApplyVertex(t *testing.T) {
+	b := NewServerBackend("ws://127.0.0.1:8182/gremlin")
+	b.Start()
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	v1.AddProperty("name", "v1")
+	e := Edge{
+		Label:    "ref",
+		InV:      id2,
+		InVLabel: "bar",
+		OutV:     id1,
+	}
+	v1.AddOutEdge(e)
+
+	props, err := b.VertexProperties(id1)
+	assert.Nil(t, err)
+	assert.Nil(t, props)
+
+	added, removed, err := b.ApplyVertex(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, 0, len(removed))
+
+	props, err = b.VertexProperties(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"v1"}, props["name"])
+
+	v1 = Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	added, removed, err = b.ApplyVertex(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(added))
+	assert.Equal(t, 1, len(removed))
+	assert.Equal(t, id2, removed[0].InV)
+
+	b.Stop()
+}
+
+func TestCluster(t *testing.T) {
+	b1 := NewServerBackend("ws://127.0.0.1:8182/gremlin")
+	b1.SetCluster("region1")
+	b1.Start()
+	b2 := NewServerBackend("ws://127.0.0.1:8182/gremlin")
+	b2.SetCluster("region2")
+	b2.Start()
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	v1 := Vertex{
+		ID:    id1,
+		Label: "foo",
+	}
+	v1.AddOutEdge(Edge{
+		Label:    "ref",
+		InV:      id2,
+		InVLabel: "bar",
+		OutV:     id1,
+	})
+	assert.Nil(t, b1.CreateVertex(v1))
+
+	var clusters []string
+	r, _ := b1.Send(
+		gremlin.Query(`g.V(id1, id2).values('cluster')`).Bindings(gremlin.Bind{"id1": id1, "id2": id2}),
+	)
+	json.Unmarshal(r, &clusters)
+	assert.Equal(t, []string{"region1", "region1"}, clusters)
+
+	// the vertex of region1 can't be modified from region2
+	assert.Equal(t, ErrClusterConflict, b2.UpdateVertex(Vertex{ID: id1, Label: "foo"}))
+	assert.Nil(t, b2.DeleteVertex(Vertex{ID: id1}))
+	props, err := b2.VertexProperties(id1)
+	assert.Nil(t, err)
+	assert.Nil(t, props)
+	props, err = b1.VertexProperties(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"region1"}, props["cluster"])
+
+	assert.Nil(t, b1.DeleteVertex(Vertex{ID: id1}))
+	props, err = b1.VertexProperties(id1)
+	assert.Nil(t, err)
+	assert.Nil(t, props)
+
+	// a _missing vertex without cluster, eg: from a dump,
+	// is claimed by the cluster that references it
+	id3, _ := uuid.NewV4()
+	id4, _ := uuid.NewV4()
+	b := NewServerBackend("ws://127.0.0.1:8182/gremlin")
+	b.Start()
+	b.Send(gremlin.Query(`g.addV('bar').property(id, _id).property('_missing', true)`).Bindings(gremlin.Bind{"_id": id3}))
+	v4 := Vertex{
+		ID:    id4,
+		Label: "foo",
+	}
+	v4.AddOutEdge(Edge{
+		Label:    "ref",
+		InV:      id3,
+		InVLabel: "bar",
+		OutV:     id4,
+	})
+	assert.Nil(t, b2.CreateVertex(v4))
+	assert.Nil(t, b2.CreateVertex(Vertex{ID: id3, Label: "bar"}))
+	props, err = b2.VertexProperties(id3)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"region2"}, props["cluster"])
+	assert.Equal(t, ErrClusterConflict, b1.UpdateVertex(Vertex{ID: id3, Label: "bar"}))
+
+	// the vertex of region2 can't be referenced from region1
+	id5, _ := uuid.NewV4()
+	assert.Equal(t, ErrClusterConflict, b1.CreateEdge(Edge{
+		Label:    "ref",
+		InV:      id3,
+		InVLabel: "bar",
+		OutV:     id5,
+	}))
+	b.Stop()
+
+	b1.Stop()
+	b2.Stop()
+}
@@ -0,0 +1,373 @@
+package gremlin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/satori/go.uuid"
+)
+
+// ValidationError is an integrity error found in a GSON file
+type ValidationError struct {
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ValidationResult summarizes the validation of a GSON file
+type ValidationResult struct {
+	Vertices int
+	Edges    int
+	Errors   []ValidationError
+}
+
+type edgeSide struct {
+	line int
+	id   int64
+}
+
+type edgeRecord struct {
+	outV  uuid.UUID
+	inV   uuid.UUID
+	label string
+	out   *edgeSide
+	in    *edgeSide
+}
+
+type missingVertex struct {
+	line  int
+	id    uuid.UUID
+	edges int
+}
+
+type gsonValidator struct {
+	vertices map[uuid.UUID]int
+	propIDs  map[int64]int
+	edges    map[string]*edgeRecord
+	edgeIDs  map[int64]string
+	missings []missingVertex
+	errors   []ValidationError
+}
+
+// ValidateGson checks the integrity of a GSON file as written by
+// GsonBackend. It checks that vertex IDs are unique, that each edge
+// is present on both of its vertices with the same ID, that property
+// and edge IDs don't collide, that typed values are well formed and
+// that _missing vertices are consistent.
+func ValidateGson(input io.Reader) (ValidationResult, error) {
+	v := &gsonValidator{
+		vertices: make(map[uuid.UUID]int),
+		propIDs:  make(map[int64]int),
+		edges:    make(map[string]*edgeRecord),
+		edgeIDs:  make(map[int64]string),
+	}
+	r := bufio.NewReader(input)
+	lineNumber := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		lineNumber++
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			v.validateVertex(lineNumber, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ValidationResult{}, err
+		}
+	}
+	v.validateEdges()
+	v.validateMissings()
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		return v.errors[i].Line < v.errors[j].Line
+	})
+	return ValidationResult{
+		Vertices: len(v.vertices),
+		Edges:    len(v.edges),
+		Errors:   v.errors,
+	}, nil
+}
+
+func (v *gsonValidator) errorf(line int, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *gsonValidator) validateVertex(line int, data []byte) {
+	var vertex struct {
+		ID         interface{}                         `json:"id"`
+		Label      string                              `json:"label"`
+		Properties map[string][]map[string]interface{} `json:"properties"`
+		InE        map[string][]map[string]interface{} `json:"inE"`
+		OutE       map[string][]map[string]interface{} `json:"outE"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&vertex); err != nil {
+		v.errorf(line, "invalid vertex: %s", err)
+		return
+	}
+
+	id, err := uuidValue(vertex.ID)
+	if err != nil {
+		v.errorf(line, "invalid vertex id: %s", err)
+		return
+	}
+	if first, ok := v.vertices[id]; ok {
+		v.errorf(line, "duplicate vertex %s, first defined at line %d", id, first)
+		return
+	}
+	v.vertices[id] = line
+	if vertex.Label == "" {
+		v.errorf(line, "vertex %s has no label", id)
+	}
+
+	for name, props := range vertex.Properties {
+		for _, p := range props {
+			propID, err := int64Value(p["id"])
+			if err != nil {
+				v.errorf(line, "invalid id of property %s: %s", name, err)
+			} else if first, ok := v.propIDs[propID]; ok {
+				v.errorf(line, "property id %d of %s already used at line %d", propID, name, first)
+			} else {
+				v.propIDs[propID] = line
+			}
+			if err := validateValue(p["value"]); err != nil {
+				v.errorf(line, "invalid value of property %s: %s", name, err)
+			}
+		}
+	}
+
+	edges := 0
+	for label, es := range vertex.OutE {
+		for _, e := range es {
+			edges++
+			v.addEdge(line, id, label, e, true)
+		}
+	}
+	for label, es := range vertex.InE {
+		for _, e := range es {
+			edges++
+			v.addEdge(line, id, label, e, false)
+		}
+	}
+
+	if _, ok := vertex.Properties["_missing"]; ok {
+		if _, ok := vertex.Properties["_dangling"]; !ok {
+			v.missings = append(v.missings, missingVertex{line: line, id: id, edges: edges})
+			if !isMissingFQName(vertex.Properties["fq_name"]) {
+				v.errorf(line, "_missing vertex %s has an fq_name", id)
+			}
+		}
+	}
+}
+
+func (v *gsonValidator) addEdge(line int, id uuid.UUID, label string, e map[string]interface{}, out bool) {
+	edgeID, err := int64Value(e["id"])
+	if err != nil {
+		v.errorf(line, "invalid id of %s edge: %s", label, err)
+		return
+	}
+	// the other side is omitted for edges to the vertex itself
+	otherKey := "inV"
+	if !out {
+		otherKey = "outV"
+	}
+	other := id
+	if value, ok := e[otherKey]; ok {
+		if other, err = uuidValue(value); err != nil {
+			v.errorf(line, "invalid %s of %s edge: %s", otherKey, label, err)
+			return
+		}
+	}
+	if props, ok := e["properties"]; ok {
+		if props, ok := props.(map[string]interface{}); ok {
+			for name, value := range props {
+				if err := validateValue(value); err != nil {
+					v.errorf(line, "invalid value of property %s of %s edge: %s", name, label, err)
+				}
+			}
+		} else {
+			v.errorf(line, "invalid properties of %s edge", label)
+		}
+	}
+
+	outV, inV := id, other
+	if !out {
+		outV, inV = other, id
+	}
+	key := outV.String() + "-" + inV.String() + "-" + label
+	record, ok := v.edges[key]
+	if !ok {
+		record = &edgeRecord{outV: outV, inV: inV, label: label}
+		v.edges[key] = record
+	}
+	side := &edgeSide{line: line, id: edgeID}
+	if out {
+		if record.out != nil {
+			v.errorf(line, "duplicate %s edge %s -> %s", label, outV, inV)
+		}
+		record.out = side
+	} else {
+		if record.in != nil {
+			v.errorf(line, "duplicate %s edge %s -> %s", label, outV, inV)
+		}
+		record.in = side
+	}
+	if firstKey, ok := v.edgeIDs[edgeID]; ok && firstKey != key {
+		first := v.edges[firstKey]
+		v.errorf(line, "edge id %d of %s edge %s -> %s is also used by %s edge %s -> %s",
+			edgeID, label, outV, inV, first.label, first.outV, first.inV)
+	} else {
+		v.edgeIDs[edgeID] = key
+	}
+}
+
+// validateEdges checks that each edge is defined on both
+// of its vertices with the same id
+func (v *gsonValidator) validateEdges() {
+	for _, r := range v.edges {
+		switch {
+		case r.out == nil:
+			if _, ok := v.vertices[r.outV]; !ok {
+				v.errorf(r.in.line, "%s edge %s -> %s references unknown vertex %s", r.label, r.outV, r.inV, r.outV)
+			} else {
+				v.errorf(r.in.line, "%s edge %s -> %s has no matching outE on %s", r.label, r.outV, r.inV, r.outV)
+			}
+		case r.in == nil:
+			if _, ok := v.vertices[r.inV]; !ok {
+				v.errorf(r.out.line, "%s edge %s -> %s references unknown vertex %s", r.label, r.outV, r.inV, r.inV)
+			} else {
+				v.errorf(r.out.line, "%s edge %s -> %s has no matching inE on %s", r.label, r.outV, r.inV, r.inV)
+			}
+		case r.out.id != r.in.id:
+			v.errorf(r.out.line, "%s edge %s -> %s has id %d but id %d on line %d",
+				r.label, r.outV, r.inV, r.out.id, r.in.id, r.in.line)
+		}
+	}
+}
+
+// validateMissings checks that _missing vertices are referenced
+func (v *gsonValidator) validateMissings() {
+	for _, m := range v.missings {
+		if m.edges == 0 {
+			v.errorf(m.line, "_missing vertex %s is not referenced", m.id)
+		}
+	}
+}
+
+func isMissingFQName(props []map[string]interface{}) bool {
+	if len(props) != 1 {
+		return false
+	}
+	fqName, ok := props[0]["value"].([]interface{})
+	return ok && len(fqName) == 1 && fqName[0] == "_missing"
+}
+
+func typedValue(value interface{}) (string, interface{}, bool) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return "", nil, false
+	}
+	t, ok := m["@type"].(string)
+	if !ok {
+		return "", nil, false
+	}
+	return t, m["@value"], true
+}
+
+func uuidValue(value interface{}) (uuid.UUID, error) {
+	t, v, ok := typedValue(value)
+	if !ok || t != "g:UUID" {
+		return uuid.Nil, fmt.Errorf("expected a g:UUID")
+	}
+	s, ok := v.(string)
+	if !ok {
+		return uuid.Nil, fmt.Errorf("g:UUID value is not a string")
+	}
+	return uuid.FromString(s)
+}
+
+func int64Value(value interface{}) (int64, error) {
+	t, v, ok := typedValue(value)
+	if !ok || (t != "g:Int64" && t != "g:Int32") {
+		return 0, fmt.Errorf("expected a g:Int64")
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s value is not a number", t)
+	}
+	return n.Int64()
+}
+
+// validateValue checks that typed values are well formed
+func validateValue(value interface{}) error {
+	switch value.(type) {
+	case []interface{}:
+		for _, item := range value.([]interface{}) {
+			if err := validateValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+	default:
+		return nil
+	}
+	t, v, ok := typedValue(value)
+	if !ok {
+		return fmt.Errorf("object without @type")
+	}
+	if _, ok := value.(map[string]interface{})["@value"]; !ok {
+		return fmt.Errorf("%s without @value", t)
+	}
+	switch t {
+	case "g:UUID":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("g:UUID value is not a string")
+		}
+		_, err := uuid.FromString(s)
+		return err
+	case "g:Int32", "g:Int64", "g:Date", "g:Timestamp":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s value is not a number", t)
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("%s value %s is not an integer", t, n)
+		}
+	case "g:Float", "g:Double", "g:Float64":
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("%s value is not a number", t)
+		}
+	case "g:List", "g:Set":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s value is not a list", t)
+		}
+		return validateValue(items)
+	case "g:Map":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("g:Map value is not a list")
+		}
+		if len(items)%2 != 0 {
+			return fmt.Errorf("g:Map value has an odd number of items")
+		}
+		return validateValue(items)
+	default:
+		return fmt.Errorf("unknown type %s", t)
+	}
+	return nil
+}
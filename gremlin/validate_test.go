@@ -0,0 +1,72 @@
+package gremlin
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateGson(t *testing.T) {
+	var buf bytes.Buffer
+	b := NewGsonBackend(&buf)
+	b.Start()
+
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	v1 := Vertex{ID: id1, Label: "foo"}
+	v1.AddProperty("prop1", map[string]interface{}{"a": []interface{}{1, 2.5}})
+	v1.AddOutEdge(Edge{Label: "ref", InV: id2, InVLabel: "bar"})
+	v2 := Vertex{ID: id2, Label: "bar"}
+	v2.AddInEdge(Edge{Label: "ref", OutV: id1, OutVLabel: "foo"})
+	v2.AddInEdge(Edge{Label: "parent", OutV: id3, OutVLabel: "baz"})
+	b.Create(v1)
+	b.Create(v2)
+	b.Stop()
+
+	result, err := ValidateGson(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.Vertices)
+	assert.Equal(t, 2, result.Edges)
+	assert.Equal(t, 0, len(result.Errors))
+}
+
+func TestValidateGsonErrors(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	lines := []string{
+		fmt.Sprintf(`{"id":{"@type":"g:UUID","@value":"%s"},"label":"foo",`+
+			`"properties":{"p":[{"id":{"@type":"g:Int64","@value":1},"value":{"@type":"g:Int64","@value":"a"}}]},`+
+			`"outE":{"ref":[{"id":{"@type":"g:Int64","@value":1},"inV":{"@type":"g:UUID","@value":"%s"}}]}}`, id1, id2),
+		fmt.Sprintf(`{"id":{"@type":"g:UUID","@value":"%s"},"label":"bar",`+
+			`"properties":{"p":[{"id":{"@type":"g:Int64","@value":1},"value":"b"}]},`+
+			`"inE":{"ref":[{"id":{"@type":"g:Int64","@value":2},"outV":{"@type":"g:UUID","@value":"%s"}}]}}`, id2, id1),
+		fmt.Sprintf(`{"id":{"@type":"g:UUID","@value":"%s"},"label":"bar"}`, id2),
+		fmt.Sprintf(`{"id":{"@type":"g:UUID","@value":"%s"},"label":"bar",`+
+			`"properties":{"fq_name":[{"id":{"@type":"g:Int64","@value":3},"value":["_missing"]}],`+
+			`"_missing":[{"id":{"@type":"g:Int64","@value":4},"value":true}]}}`, id3),
+		`{"id": "foo"`,
+	}
+
+	result, err := ValidateGson(strings.NewReader(strings.Join(lines, "\n")))
+	assert.Nil(t, err)
+
+	errors := make([]string, len(result.Errors))
+	for i, e := range result.Errors {
+		errors[i] = e.Error()
+	}
+	assert.Equal(t, 6, len(errors), strings.Join(errors, "\n"))
+	assert.Contains(t, errors[0], "line 1: invalid value of property p")
+	assert.Contains(t, errors[1], "line 1: ref edge")
+	assert.Contains(t, errors[1], "has id 1 but id 2 on line 2")
+	assert.Contains(t, errors[2], "line 2: property id 1 of p already used at line 1")
+	assert.Contains(t, errors[3], "line 3: duplicate vertex")
+	assert.Contains(t, errors[4], "line 4: _missing vertex")
+	assert.Contains(t, errors[4], "is not referenced")
+	assert.Contains(t, errors[5], "line 5: invalid vertex")
+}
@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// wrappedProperty describes a property that is stored in propm or
+// propl columns in cassandra and that contrail-api wraps in an object
+type wrappedProperty struct {
+	field string
+	isMap bool
+}
+
+var wrappedProperties = map[string]wrappedProperty{
+	"virtual_machine_interface_bindings":           {field: "key_value_pair", isMap: true},
+	"virtual_machine_interface_fat_flow_protocols": {field: "fat_flow_protocol"},
+	"service_instance_bindings":                    {field: "key_value_pair", isMap: true},
+}
+
+// ContrailAPIReader reads contrail resources from the contrail-api
+type ContrailAPIReader struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewContrailAPIReader returns a reader using the contrail-api at apiURL.
+// If token is not empty it is sent in the X-Auth-Token header.
+func NewContrailAPIReader(apiURL string, token string) *ContrailAPIReader {
+	return &ContrailAPIReader{
+		url:   strings.TrimRight(apiURL, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+func (r *ContrailAPIReader) do(method string, path string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("X-Auth-Token", r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrResourceNotFound
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return dec.Decode(result)
+}
+
+// Types returns the resource types exposed by the contrail-api
+func (r *ContrailAPIReader) Types() ([]string, error) {
+	var home struct {
+		Links []struct {
+			Link struct {
+				Name string `json:"name"`
+				Rel  string `json:"rel"`
+			} `json:"link"`
+		} `json:"links"`
+	}
+	if err := r.do("GET", "/", nil, &home); err != nil {
+		return nil, err
+	}
+	types := make([]string, 0)
+	for _, l := range home.Links {
+		if l.Link.Rel == "collection" {
+			types = append(types, l.Link.Name)
+		}
+	}
+	return types, nil
+}
+
+// GetResource returns the resource from the contrail-api
+func (r *ContrailAPIReader) GetResource(rUUID uuid.UUID) (g.Vertex, error) {
+	var fqName struct {
+		Type string `json:"type"`
+	}
+	err := r.do("POST", "/id-to-fqname", map[string]string{"uuid": rUUID.String()}, &fqName)
+	if err != nil {
+		return g.Vertex{}, err
+	}
+	var res map[string]map[string]interface{}
+	err = r.do("GET", fmt.Sprintf("/%s/%s", fqName.Type, rUUID), nil, &res)
+	if err != nil {
+		return g.Vertex{}, err
+	}
+	data, ok := res[fqName.Type]
+	if !ok {
+		return g.Vertex{}, ErrResourceNotFound
+	}
+	return BuildContrailAPIResource(fqName.Type, data)
+}
+
+// GetResources sends all resources of type resType
+func (r *ContrailAPIReader) GetResources(resType string, vertices chan g.Vertex) error {
+	var res map[string][]map[string]map[string]interface{}
+	if err := r.do("GET", fmt.Sprintf("/%ss?detail=true", resType), nil, &res); err != nil {
+		return err
+	}
+	for _, item := range res[resType+"s"] {
+		vertex, err := BuildContrailAPIResource(resType, item[resType])
+		if err != nil {
+			return err
+		}
+		vertices <- vertex
+	}
+	return nil
+}
+
+// BuildContrailAPIResource builds the vertex of a resource from its
+// contrail-api representation, the same way BuildContrailResource does
+func BuildContrailAPIResource(resType string, data map[string]interface{}) (g.Vertex, error) {
+	rUUID, err := uuid.FromString(fmt.Sprintf("%s", data["uuid"]))
+	if err != nil {
+		return g.Vertex{}, err
+	}
+	vertex := g.Vertex{
+		ID:    rUUID,
+		Label: apiTypeToType(resType),
+	}
+	for key, value := range data {
+		switch {
+		case key == "uuid", key == "name", key == "href", key == "parent_href",
+			key == "parent_uuid", key == "parent_type":
+			continue
+		case key == "fq_name":
+			vertex.AddSingleProperty("fq_name", stringList(value))
+		case strings.HasSuffix(key, "_back_refs"):
+			for _, link := range apiLinks(value) {
+				edge := g.Edge{
+					Label:     "ref",
+					OutV:      link.uuid,
+					OutVLabel: strings.TrimSuffix(key, "_back_refs"),
+					InV:       rUUID,
+				}
+				edge.AddProperties(link.attr)
+				vertex.AddInEdge(edge)
+			}
+		case strings.HasSuffix(key, "_refs"):
+			for _, link := range apiLinks(value) {
+				edge := g.Edge{
+					Label:    "ref",
+					InV:      link.uuid,
+					InVLabel: strings.TrimSuffix(key, "_refs"),
+					OutV:     rUUID,
+				}
+				edge.AddProperties(link.attr)
+				vertex.AddOutEdge(edge)
+			}
+		case isAPIChildren(value):
+			for _, link := range apiLinks(value) {
+				vertex.AddInEdge(g.Edge{
+					Label:     "parent",
+					OutV:      link.uuid,
+					OutVLabel: strings.TrimSuffix(key, "s"),
+					InV:       rUUID,
+				})
+			}
+		default:
+			if value == nil {
+				continue
+			}
+			if w, ok := wrappedProperties[key]; ok {
+				value = unwrapProperty(w, value)
+			}
+			vertex.AddProperty(key, value)
+		}
+	}
+	if parentUUID, err := uuid.FromString(fmt.Sprintf("%s", data["parent_uuid"])); err == nil {
+		vertex.AddOutEdge(g.Edge{
+			Label:    "parent",
+			InV:      parentUUID,
+			InVLabel: apiTypeToType(fmt.Sprintf("%s", data["parent_type"])),
+			OutV:     rUUID,
+		})
+		vertex.AddSingleProperty("parent_uuid", parentUUID)
+	}
+	return completeContrailResource(vertex)
+}
+
+type apiLink struct {
+	uuid uuid.UUID
+	attr map[string]interface{}
+}
+
+// apiLinks parses a list of refs, back_refs or children
+func apiLinks(value interface{}) []apiLink {
+	links := make([]apiLink, 0)
+	items, _ := value.([]interface{})
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		linkUUID, err := uuid.FromString(fmt.Sprintf("%s", m["uuid"]))
+		if err != nil {
+			continue
+		}
+		link := apiLink{uuid: linkUUID}
+		if attr, ok := m["attr"].(map[string]interface{}); ok {
+			link.attr = attr
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// isAPIChildren returns true if value is a list of links to other resources
+func isAPIChildren(value interface{}) bool {
+	items, ok := value.([]interface{})
+	if !ok || len(items) == 0 {
+		return false
+	}
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for _, k := range []string{"to", "href", "uuid"} {
+			if _, ok := m[k]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// unwrapProperty returns the value of a map or list
+// property as built from propm or propl columns
+func unwrapProperty(w wrappedProperty, value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	items, ok := m[w.field].([]interface{})
+	if !ok {
+		return value
+	}
+	if !w.isMap {
+		return items
+	}
+	props := make(map[string]interface{})
+	for _, item := range items {
+		if kv, ok := item.(map[string]interface{}); ok {
+			props[fmt.Sprintf("%s", kv["key"])] = kv["value"]
+		}
+	}
+	return props
+}
+
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	list := make([]string, len(items))
+	for i, item := range items {
+		list[i] = fmt.Sprintf("%s", item)
+	}
+	return list
+}
+
+// apiTypeToType converts contrail-api types (virtual-network)
+// to DB types (virtual_network)
+func apiTypeToType(resType string) string {
+	return strings.Replace(resType, "-", "_", -1)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+func contrailAPIServer(resources map[uuid.UUID]map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/id-to-fqname", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		id, _ := uuid.FromString(body["uuid"])
+		if _, ok := resources[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"type": "virtual-network", "fq_name": ["vn"]}`)
+	})
+	mux.HandleFunc("/virtual-network/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := uuid.FromString(r.URL.Path[len("/virtual-network/"):])
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"virtual-network": resources[id],
+		})
+	})
+	mux.HandleFunc("/virtual-networks", func(w http.ResponseWriter, r *http.Request) {
+		items := make([]interface{}, 0)
+		for _, res := range resources {
+			items = append(items, map[string]interface{}{"virtual-network": res})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"virtual-networks": items,
+		})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"links": [
+			{"link": {"rel": "collection", "name": "virtual-network"}},
+			{"link": {"rel": "resource-base", "name": "virtual-network"}}
+		]}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestContrailAPIGetResource(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	id4, _ := uuid.NewV4()
+	query := "SELECT key, column1, value FROM obj_uuid_table WHERE key=?"
+
+	// the same resource in cassandra and in the contrail-api
+	session := &gockle.SessionMock{}
+	session.When("ScanMapSlice", query, []interface{}{id1.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"virtual_network"`},
+			{"column1": []byte("fq_name"), "value": `["default-domain", "admin", "vn"]`},
+			{"column1": []byte("parent:project:" + id4.String()), "value": `null`},
+			{"column1": []byte("prop:id_perms"), "value": `{"created": "2018-03-05T06:21:57.186987", "enable": true}`},
+			{"column1": []byte("prop:virtual_network_network_id"), "value": `4`},
+			{"column1": []byte("ref:network_ipam:" + id2.String()), "value": `{"attr": {"host_routes": null}}`},
+			{"column1": []byte("children:routing_instance:" + id3.String()), "value": `null`},
+		},
+		nil,
+	)
+	srv := contrailAPIServer(map[uuid.UUID]map[string]interface{}{
+		id1: {
+			"uuid":                       id1.String(),
+			"name":                       "vn",
+			"href":                       "http://localhost/virtual-network/" + id1.String(),
+			"fq_name":                    []string{"default-domain", "admin", "vn"},
+			"parent_type":                "project",
+			"parent_uuid":                id4.String(),
+			"id_perms":                   map[string]interface{}{"created": "2018-03-05T06:21:57.186987", "enable": true},
+			"display_name":               nil,
+			"virtual_network_network_id": 4,
+			"network_ipam_refs": []interface{}{
+				map[string]interface{}{"to": []string{"ipam"}, "uuid": id2.String(), "href": "", "attr": map[string]interface{}{"host_routes": nil}},
+			},
+			"routing_instances": []interface{}{
+				map[string]interface{}{"to": []string{"ri"}, "uuid": id3.String(), "href": ""},
+			},
+		},
+	})
+	defer srv.Close()
+
+	expectedVertex, _ := GetContrailResource(session, id1)
+
+	reader := NewContrailAPIReader(srv.URL, "")
+	vertex, err := reader.GetResource(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedVertex, vertex)
+
+	_, err = reader.GetResource(id2)
+	assert.Equal(t, ErrResourceNotFound, err)
+}
+
+func TestContrailAPIGetResources(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	srv := contrailAPIServer(map[uuid.UUID]map[string]interface{}{
+		id1: {
+			"uuid":                                id1.String(),
+			"fq_name":                             []string{"vn"},
+			"virtual_machine_interface_back_refs": []interface{}{},
+		},
+	})
+	defer srv.Close()
+
+	reader := NewContrailAPIReader(srv.URL, "")
+	types, err := reader.Types()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"virtual-network"}, types)
+
+	vertices := make(chan g.Vertex, 10)
+	err = reader.GetResources("virtual-network", vertices)
+	close(vertices)
+	assert.Nil(t, err)
+	vertex := <-vertices
+	assert.Equal(t, id1, vertex.ID)
+	assert.Equal(t, "virtual_network", vertex.Label)
+	assert.True(t, vertex.HasProp("_incomplete"))
+}
+
+func TestUnwrapProperty(t *testing.T) {
+	value := map[string]interface{}{
+		"key_value_pair": []interface{}{
+			map[string]interface{}{"key": "host_id", "value": "compute1"},
+		},
+	}
+	assert.Equal(t, map[string]interface{}{"host_id": "compute1"},
+		unwrapProperty(wrappedProperties["virtual_machine_interface_bindings"], value))
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// ReadCSVResources reads an obj_uuid_table export made with
+// `cqlsh COPY obj_uuid_table TO` and sends a vertex for each resource
+func ReadCSVResources(input io.Reader, vertices chan g.Vertex) error {
+	b := newResourceBuilder(vertices)
+	err := readCSVRows(input, func(key string, column1 string, value string) error {
+		return b.add(map[string]interface{}{
+			"key":     []byte(key),
+			"column1": []byte(column1),
+			"value":   value,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// ReadCSVFQNameEntries reads an obj_fq_name_table export made with
+// `cqlsh COPY obj_fq_name_table TO` and sends all its entries
+func ReadCSVFQNameEntries(input io.Reader, entries chan FQNameEntry) error {
+	return readCSVRows(input, func(key string, column1 string, value string) error {
+		if entry, err := parseFQNameEntry(key, column1); err == nil {
+			entries <- entry
+		}
+		return nil
+	})
+}
+
+// readCSVRows calls fn for each key, column1, value row of a
+// cqlsh export. The header line is skipped if present.
+func readCSVRows(input io.Reader, fn func(string, string, string) error) error {
+	r := csv.NewReader(input)
+	r.FieldsPerRecord = 3
+	r.LazyQuotes = true
+	first := true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			first = false
+			if record[0] == "key" && record[1] == "column1" {
+				continue
+			}
+		}
+		key, err := decodeCSVBlob(record[0])
+		if err != nil {
+			return err
+		}
+		column1, err := decodeCSVBlob(record[1])
+		if err != nil {
+			return err
+		}
+		if err := fn(key, column1, record[2]); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeCSVBlob decodes blob columns that cqlsh exports
+// in hexadecimal (0x...)
+func decodeCSVBlob(value string) (string, error) {
+	if !strings.HasPrefix(value, "0x") {
+		return value, nil
+	}
+	data, err := hex.DecodeString(value[2:])
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+func csvBlob(value string) string {
+	return "0x" + hex.EncodeToString([]byte(value))
+}
+
+func TestReadCSVResources(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	id3, _ := uuid.NewV4()
+	query := "SELECT key, column1, value FROM obj_uuid_table WHERE key=?"
+
+	session := &gockle.SessionMock{}
+	session.When("ScanMapSlice", query, []interface{}{id1.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"foo"`},
+			{"column1": []byte("fq_name"), "value": `["foo"]`},
+			{"column1": []byte("prop:object"), "value": `{"bool": false, "list": [1, "a,b"]}`},
+			{"column1": []byte("propl:list:0"), "value": `"a"`},
+			{"column1": []byte("propl:list:1"), "value": `"b"`},
+			{"column1": []byte("ref:bar:" + id2.String()), "value": `{"attr": {"foo": false}}`},
+		},
+		nil,
+	)
+	expectedVertex, _ := GetContrailResource(session, id1)
+
+	lines := []string{
+		"key,column1,value",
+		fmt.Sprintf(`%s,%s,"""foo"""`, csvBlob(id1.String()), csvBlob("type")),
+		fmt.Sprintf(`%s,%s,"[""foo""]"`, csvBlob(id1.String()), csvBlob("fq_name")),
+		fmt.Sprintf(`%s,%s,"{""bool"": false, ""list"": [1, ""a,b""]}"`, csvBlob(id1.String()), csvBlob("prop:object")),
+		fmt.Sprintf(`%s,%s,"""a"""`, csvBlob(id1.String()), csvBlob("propl:list:0")),
+		fmt.Sprintf(`%s,%s,"""b"""`, csvBlob(id1.String()), csvBlob("propl:list:1")),
+		fmt.Sprintf(`%s,%s,"{""attr"": {""foo"": false}}"`, csvBlob(id1.String()), csvBlob("ref:bar:"+id2.String())),
+		fmt.Sprintf(`%s,%s,"""bar"""`, csvBlob(id3.String()), csvBlob("type")),
+	}
+
+	vertices := make(chan g.Vertex, 10)
+	err := ReadCSVResources(strings.NewReader(strings.Join(lines, "\n")), vertices)
+	close(vertices)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expectedVertex, <-vertices)
+	assert.Equal(t, id3, (<-vertices).ID)
+}
+
+func TestReadCSVFQNameEntries(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	input := fmt.Sprintf("%s,%s,null\n", csvBlob("virtual_network"),
+		csvBlob("default-domain:admin:vn1:"+id1.String()))
+
+	entries := make(chan FQNameEntry, 10)
+	err := ReadCSVFQNameEntries(strings.NewReader(input), entries)
+	close(entries)
+
+	assert.Nil(t, err)
+	assert.Equal(t, FQNameEntry{
+		Type:   "virtual_network",
+		FQName: []string{"default-domain", "admin", "vn1"},
+		UUID:   id1,
+	}, <-entries)
+}
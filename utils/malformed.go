@@ -0,0 +1,45 @@
+package utils
+
+import (
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// Kinds of malformed columns found in obj_uuid_table
+const (
+	MalformedJSON      = "invalid_json"
+	MalformedUUID      = "invalid_uuid"
+	MalformedListIndex = "invalid_list_index"
+	MalformedColumn    = "unknown_column"
+)
+
+// Malformation describes a malformed column of a resource
+type Malformation struct {
+	Kind   string `json:"kind"`
+	Column string `json:"column"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// addMalformation attaches the malformation to the
+// vertex in the _malformed property
+func addMalformation(vertex *g.Vertex, m Malformation) {
+	vertex.AddProperty("_malformed", map[string]interface{}{
+		"kind":   m.Kind,
+		"column": m.Column,
+		"detail": m.Detail,
+	})
+}
+
+// Malformations returns the malformations attached to the vertex
+func Malformations(vertex g.Vertex) []Malformation {
+	props := vertex.Properties["_malformed"]
+	ms := make([]Malformation, 0, len(props))
+	for _, p := range props {
+		if m, ok := p.Value.(map[string]interface{}); ok {
+			kind, _ := m["kind"].(string)
+			column, _ := m["column"].(string)
+			detail, _ := m["detail"].(string)
+			ms = append(ms, Malformation{Kind: kind, Column: column, Detail: detail})
+		}
+	}
+	return ms
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"math"
+
+	"github.com/satori/go.uuid"
+	"github.com/willfaught/gockle"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+)
+
+// TokenRange is an inclusive range of the Murmur3 token ring
+type TokenRange struct {
+	Start int64
+	End   int64
+}
+
+// SplitTokenRing splits the whole token ring in n contiguous ranges
+func SplitTokenRing(n int) []TokenRange {
+	if n < 1 {
+		n = 1
+	}
+	step := uint64(math.MaxUint64) / uint64(n)
+	ranges := make([]TokenRange, n)
+	for i := 0; i < n; i++ {
+		ranges[i].Start = math.MinInt64 + int64(uint64(i)*step)
+		if i > 0 {
+			ranges[i-1].End = ranges[i].Start - 1
+		}
+	}
+	ranges[n-1].End = math.MaxInt64
+	return ranges
+}
+
+// ScanContrailResources reads obj_uuid_table rows in the token range r
+// and sends a vertex for each resource found.
+func ScanContrailResources(session gockle.Session, r TokenRange, vertices chan g.Vertex) error {
+	b := newResourceBuilder(vertices)
+	it := session.ScanIterator(`SELECT key, column1, value FROM obj_uuid_table WHERE token(key) >= ? AND token(key) <= ?`, r.Start, r.End)
+	for {
+		row := make(map[string]interface{})
+		if !it.ScanMap(row) {
+			break
+		}
+		if err := b.add(row); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// resourceBuilder builds vertices from a stream of obj_uuid_table rows.
+// Rows of a partition are contiguous in a scan or in an export so a
+// vertex is built as soon as the key changes.
+type resourceBuilder struct {
+	current  uuid.UUID
+	rows     []map[string]interface{}
+	vertices chan g.Vertex
+}
+
+func newResourceBuilder(vertices chan g.Vertex) *resourceBuilder {
+	return &resourceBuilder{vertices: vertices}
+}
+
+func (b *resourceBuilder) add(row map[string]interface{}) error {
+	rUUID, err := uuid.FromString(columnString(row["key"]))
+	if err != nil {
+		return nil
+	}
+	if rUUID != b.current {
+		if err := b.flush(); err != nil {
+			return err
+		}
+		b.current = rUUID
+	}
+	b.rows = append(b.rows, row)
+	return nil
+}
+
+func (b *resourceBuilder) flush() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	vertex, err := BuildContrailResource(b.current, b.rows)
+	if err != nil {
+		return err
+	}
+	b.vertices <- vertex
+	b.rows = nil
+	return nil
+}
+
+// columnString returns the string value of a blob or text column
+func columnString(value interface{}) string {
+	switch value.(type) {
+	case []byte:
+		return string(value.([]byte))
+	case string:
+		return value.(string)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"math"
+	"testing"
+
+	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/maraino/go-mock"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/willfaught/gockle"
+)
+
+// rowsIterator returns an iterator mock that yields the given rows
+func rowsIterator(rows []map[string]interface{}) *gockle.IteratorMock {
+	it := &gockle.IteratorMock{}
+	i := 0
+	it.When("ScanMap", mock.Any).Call(func(row map[string]interface{}) bool {
+		if i >= len(rows) {
+			return false
+		}
+		for k, v := range rows[i] {
+			row[k] = v
+		}
+		i++
+		return true
+	})
+	it.When("Close").Return(nil)
+	return it
+}
+
+func TestSplitTokenRing(t *testing.T) {
+	ranges := SplitTokenRing(4)
+
+	assert.Equal(t, 4, len(ranges))
+	assert.Equal(t, int64(math.MinInt64), ranges[0].Start)
+	assert.Equal(t, int64(math.MaxInt64), ranges[3].End)
+	for i := 1; i < len(ranges); i++ {
+		assert.Equal(t, ranges[i-1].End+1, ranges[i].Start)
+	}
+
+	assert.Equal(t, []TokenRange{{Start: math.MinInt64, End: math.MaxInt64}},
+		SplitTokenRing(0))
+}
+
+func TestScanContrailResources(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	query := "SELECT key, column1, value FROM obj_uuid_table WHERE token(key) >= ? AND token(key) <= ?"
+	r := TokenRange{Start: 0, End: 100}
+
+	session := &gockle.SessionMock{}
+	session.When("ScanIterator", query, []interface{}{r.Start, r.End}).Return(
+		rowsIterator([]map[string]interface{}{
+			{"key": []byte(id1.String()), "column1": []byte("type"), "value": `"foo"`},
+			{"key": []byte(id1.String()), "column1": []byte("fq_name"), "value": `["foo"]`},
+			{"key": []byte("not-a-uuid"), "column1": []byte("type"), "value": `"foo"`},
+			{"key": []byte(id2.String()), "column1": []byte("type"), "value": `"bar"`},
+		}),
+	)
+
+	vertices := make(chan g.Vertex, 10)
+	err := ScanContrailResources(session, r, vertices)
+	close(vertices)
+
+	assert.Nil(t, err)
+	var labels []string
+	for v := range vertices {
+		labels = append(labels, v.Label)
+		if v.Label == "foo" {
+			assert.Equal(t, id1, v.ID)
+			assert.True(t, v.HasProp("fq_name"))
+		} else {
+			assert.Equal(t, id2, v.ID)
+		}
+	}
+	assert.Equal(t, []string{"foo", "bar"}, labels)
+}
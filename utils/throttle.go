@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/willfaught/gockle"
+)
+
+// RateLimiter spaces out calls to Wait to
+// respect a maximum number of calls per second
+type RateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+// NewRateLimiter returns a limiter allowing qps calls per second
+func NewRateLimiter(qps int) *RateLimiter {
+	return &RateLimiter{
+		interval: time.Second / time.Duration(qps),
+	}
+}
+
+// Wait blocks until the next call is allowed
+func (r *RateLimiter) Wait() {
+	r.mutex.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mutex.Unlock()
+	time.Sleep(wait)
+}
+
+type rateLimitedSession struct {
+	gockle.Session
+	limiter *RateLimiter
+}
+
+// NewRateLimitedSession returns a session that sends at most
+// qps queries per second. Pages fetched by iterators are not limited.
+func NewRateLimitedSession(session gockle.Session, qps int) gockle.Session {
+	return rateLimitedSession{
+		Session: session,
+		limiter: NewRateLimiter(qps),
+	}
+}
+
+func (s rateLimitedSession) Exec(statement string, arguments ...interface{}) error {
+	s.limiter.Wait()
+	return s.Session.Exec(statement, arguments...)
+}
+
+func (s rateLimitedSession) Scan(statement string, results []interface{}, arguments ...interface{}) error {
+	s.limiter.Wait()
+	return s.Session.Scan(statement, results, arguments...)
+}
+
+func (s rateLimitedSession) ScanIterator(statement string, arguments ...interface{}) gockle.Iterator {
+	s.limiter.Wait()
+	return s.Session.ScanIterator(statement, arguments...)
+}
+
+func (s rateLimitedSession) ScanMap(statement string, results map[string]interface{}, arguments ...interface{}) error {
+	s.limiter.Wait()
+	return s.Session.ScanMap(statement, results, arguments...)
+}
+
+func (s rateLimitedSession) ScanMapSlice(statement string, arguments ...interface{}) ([]map[string]interface{}, error) {
+	s.limiter.Wait()
+	return s.Session.ScanMapSlice(statement, arguments...)
+}
+
+func (s rateLimitedSession) ScanMapTx(statement string, results map[string]interface{}, arguments ...interface{}) (bool, error) {
+	s.limiter.Wait()
+	return s.Session.ScanMapTx(statement, results, arguments...)
+}
+
+// AdaptiveLimiter limits the number of concurrent queries. The limit
+// is halved when a query fails or is slower than the target latency,
+// and grows back by one after a limit's worth of fast queries. The
+// queries sent before the limit was halved don't halve it again.
+type AdaptiveLimiter struct {
+	max       int
+	limit     int
+	running   int
+	successes int
+	target    time.Duration
+	backoff   time.Time
+	cond      *sync.Cond
+	mutex     sync.Mutex
+}
+
+// NewAdaptiveLimiter returns a limiter allowing up to max
+// concurrent queries that should take less than target
+func NewAdaptiveLimiter(max int, target time.Duration) *AdaptiveLimiter {
+	l := &AdaptiveLimiter{
+		max:    max,
+		limit:  max,
+		target: target,
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// Acquire blocks until a query can be sent
+func (l *AdaptiveLimiter) Acquire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.running >= l.limit {
+		l.cond.Wait()
+	}
+	l.running++
+}
+
+// Release records the outcome of a query and adjusts the limit
+func (l *AdaptiveLimiter) Release(latency time.Duration, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.running--
+	if err != nil || latency > l.target {
+		l.successes = 0
+		// unless the query was running when the limit was halved
+		now := time.Now()
+		if !now.Add(-latency).Before(l.backoff) && l.limit > 1 {
+			l.backoff = now
+			l.limit = l.limit / 2
+		}
+	} else {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.successes = 0
+			l.limit++
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// Limit returns the current number of allowed concurrent queries
+func (l *AdaptiveLimiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.Wait()
+	}
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := NewAdaptiveLimiter(8, 100*time.Millisecond)
+	assert.Equal(t, 8, l.Limit())
+
+	l.Acquire()
+	l.Acquire()
+	l.Release(200*time.Millisecond, nil)
+	assert.Equal(t, 4, l.Limit())
+
+	// sent before the limit was halved
+	l.Release(200*time.Millisecond, nil)
+	assert.Equal(t, 4, l.Limit())
+
+	time.Sleep(10 * time.Millisecond)
+	l.Acquire()
+	l.Release(time.Millisecond, errors.New("timeout"))
+	assert.Equal(t, 2, l.Limit())
+
+	for i := 0; i < 2; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, nil)
+	}
+	assert.Equal(t, 3, l.Limit())
+
+	// the limit is never above max
+	for i := 0; i < 100; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, nil)
+	}
+	assert.Equal(t, 8, l.Limit())
+}
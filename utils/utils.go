@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -51,48 +52,94 @@ func GetContrailUUIDs(session gockle.Session, uuids chan uuid.UUID) error {
 	return r.Close()
 }
 
-func generateEdgeProperties(valueJSON []byte) (map[string]interface{}, bool) {
+// FQNameEntry is an entry of obj_fq_name_table
+type FQNameEntry struct {
+	Type   string
+	FQName []string
+	UUID   uuid.UUID
+}
+
+// GetContrailFQNameEntries lists all entries of obj_fq_name_table
+func GetContrailFQNameEntries(session gockle.Session, entries chan FQNameEntry) error {
+	var (
+		key     string
+		column1 string
+	)
+	r := session.ScanIterator(`SELECT key, column1 FROM obj_fq_name_table`)
+	for r.Scan(&key, &column1) {
+		if entry, err := parseFQNameEntry(key, column1); err == nil {
+			entries <- entry
+		}
+	}
+	return r.Close()
+}
+
+// parseFQNameEntry parses an obj_fq_name_table row where
+// key is the resource type and column1 is <fq_name>:<uuid>
+func parseFQNameEntry(key string, column1 string) (FQNameEntry, error) {
+	parts := strings.Split(column1, ":")
+	uuid, err := uuid.FromString(parts[len(parts)-1])
+	if err != nil {
+		return FQNameEntry{}, err
+	}
+	return FQNameEntry{
+		Type:   key,
+		FQName: parts[:len(parts)-1],
+		UUID:   uuid,
+	}, nil
+}
+
+// GetContrailUUIDTableKeys lists all keys of obj_uuid_table
+func GetContrailUUIDTableKeys(session gockle.Session, uuids chan uuid.UUID) error {
+	var (
+		key string
+	)
+	r := session.ScanIterator(`SELECT DISTINCT key FROM obj_uuid_table`)
+	for r.Scan(&key) {
+		uuid, err := uuid.FromString(key)
+		if err == nil {
+			uuids <- uuid
+		}
+	}
+	return r.Close()
+}
+
+func generateEdgeProperties(valueJSON []byte) (map[string]interface{}, bool, error) {
 	if len(valueJSON) > 0 {
 		value, err := parseJSON(valueJSON)
 		if err != nil {
-			fmt.Println(fmt.Errorf("Failed to parse %v", string(valueJSON)))
-		} else {
-			switch value.Data().(type) {
-			case map[string]interface{}:
-				if props, ok := value.Data().(map[string]interface{})["attr"]; ok {
-					switch props.(type) {
-					case map[string]interface{}:
-						return props.(map[string]interface{}), true
-					}
+			return nil, false, err
+		}
+		switch value.Data().(type) {
+		case map[string]interface{}:
+			if props, ok := value.Data().(map[string]interface{})["attr"]; ok {
+				switch props.(type) {
+				case map[string]interface{}:
+					return props.(map[string]interface{}), true, nil
 				}
 			}
 		}
 	}
-	return nil, false
+	return nil, false, nil
 }
 
-func generateVertexProperty(valueJSON []byte) (interface{}, bool) {
+func generateVertexProperty(valueJSON []byte) (interface{}, bool, error) {
 	if len(valueJSON) > 0 {
 		value, err := parseJSON(valueJSON)
 		if err != nil {
-			fmt.Println(fmt.Errorf("Failed to parse %v", string(valueJSON)))
-		} else {
-			switch value.Data().(type) {
-			case nil:
-				return nil, false
-			default:
-				return value.Data().(interface{}), true
-			}
+			return nil, false, err
+		}
+		switch value.Data().(type) {
+		case nil:
+			return nil, false, nil
+		default:
+			return value.Data().(interface{}), true, nil
 		}
 	}
-	return nil, false
+	return nil, false, nil
 }
 
 func GetContrailResource(session gockle.Session, rUUID uuid.UUID) (g.Vertex, error) {
-	var (
-		column1   string
-		valueJSON []byte
-	)
 	rows, err := session.ScanMapSlice(`SELECT key, column1, value FROM obj_uuid_table WHERE key=?`, rUUID.String())
 	if err != nil {
 		return g.Vertex{}, err
@@ -100,9 +147,58 @@ func GetContrailResource(session gockle.Session, rUUID uuid.UUID) (g.Vertex, err
 	if len(rows) == 0 {
 		return g.Vertex{}, ErrResourceNotFound
 	}
+	return BuildContrailResource(rUUID, rows)
+}
+
+// GetContrailLastModified returns the id_perms.last_modified
+// timestamp of the resource
+func GetContrailLastModified(session gockle.Session, rUUID uuid.UUID) (int64, error) {
+	lastModified, err := GetContrailLastModifiedTime(session, rUUID)
+	if err != nil {
+		return 0, err
+	}
+	return lastModified.Unix(), nil
+}
+
+// GetContrailLastModifiedTime returns the id_perms.last_modified
+// of the resource with its full precision
+func GetContrailLastModifiedTime(session gockle.Session, rUUID uuid.UUID) (time.Time, error) {
+	rows, err := session.ScanMapSlice(`SELECT value FROM obj_uuid_table WHERE key=? AND column1=?`,
+		rUUID.String(), "prop:id_perms")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(rows) == 0 {
+		return time.Time{}, ErrResourceNotFound
+	}
+	var idPerms struct {
+		LastModified string `json:"last_modified"`
+	}
+	if err := json.Unmarshal([]byte(columnString(rows[0]["value"])), &idPerms); err != nil {
+		return time.Time{}, err
+	}
+	return ParseContrailTime(idPerms.LastModified)
+}
+
+// ParseContrailTime parses a timestamp of id_perms
+func ParseContrailTime(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, value+`Z`)
+}
+
+// BuildContrailResource builds the vertex of a resource from
+// its obj_uuid_table rows. Columns that can't be parsed are
+// reported in the _malformed property of the vertex.
+func BuildContrailResource(rUUID uuid.UUID, rows []map[string]interface{}) (g.Vertex, error) {
+	var (
+		column1   string
+		valueJSON []byte
+	)
 	vertex := g.Vertex{
 		ID: rUUID,
 	}
+	malformed := func(kind string, column string, detail string) {
+		addMalformation(&vertex, Malformation{Kind: kind, Column: column, Detail: detail})
+	}
 	mapProperties := make(map[string]map[string]json.RawMessage, 0)
 	listProperties := make(map[string]map[int]json.RawMessage, 0)
 	for _, row := range rows {
@@ -112,14 +208,26 @@ func GetContrailResource(session gockle.Session, rUUID uuid.UUID) (g.Vertex, err
 		switch split[0] {
 		case "parent", "ref":
 			label := split[0]
-			inVUUID, _ := uuid.FromString(split[2])
+			if len(split) != 3 {
+				malformed(MalformedColumn, column1, "expected <type>:<uuid>")
+				continue
+			}
+			inVUUID, err := uuid.FromString(split[2])
+			if err != nil {
+				malformed(MalformedUUID, column1, err.Error())
+				continue
+			}
 			edge := g.Edge{
 				Label:    label,
 				InV:      inVUUID,
 				InVLabel: split[1],
 				OutV:     rUUID,
 			}
-			if props, ok := generateEdgeProperties(valueJSON); ok {
+			props, ok, err := generateEdgeProperties(valueJSON)
+			if err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+			}
+			if ok {
 				edge.AddProperties(props)
 			}
 			vertex.AddOutEdge(edge)
@@ -133,70 +241,137 @@ func GetContrailResource(session gockle.Session, rUUID uuid.UUID) (g.Vertex, err
 			} else {
 				label = "parent"
 			}
-			outVUUID, _ := uuid.FromString(split[2])
+			if len(split) != 3 {
+				malformed(MalformedColumn, column1, "expected <type>:<uuid>")
+				continue
+			}
+			outVUUID, err := uuid.FromString(split[2])
+			if err != nil {
+				malformed(MalformedUUID, column1, err.Error())
+				continue
+			}
 			edge := g.Edge{
 				Label:     label,
 				OutV:      outVUUID,
 				OutVLabel: split[1],
 				InV:       rUUID,
 			}
-			if props, ok := generateEdgeProperties(valueJSON); ok {
+			props, ok, err := generateEdgeProperties(valueJSON)
+			if err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+			}
+			if ok {
 				edge.AddProperties(props)
 			}
 			vertex.AddInEdge(edge)
 		case "type":
 			var value string
-			json.Unmarshal(valueJSON, &value)
+			if err := json.Unmarshal(valueJSON, &value); err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+				continue
+			}
 			vertex.Label = value
 		case "fq_name":
 			var value []string
-			json.Unmarshal(valueJSON, &value)
+			if err := json.Unmarshal(valueJSON, &value); err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+				continue
+			}
 			vertex.AddSingleProperty("fq_name", value)
 		case "prop":
-			if propValue, ok := generateVertexProperty(valueJSON); ok {
+			if len(split) != 2 {
+				malformed(MalformedColumn, column1, "expected prop:<name>")
+				continue
+			}
+			propValue, ok, err := generateVertexProperty(valueJSON)
+			if err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+			}
+			if ok {
 				vertex.AddProperty(split[1], propValue)
 			}
 		case "propm":
+			if len(split) != 3 {
+				malformed(MalformedColumn, column1, "expected propm:<name>:<key>")
+				continue
+			}
 			var value map[string]json.RawMessage
-			json.Unmarshal(valueJSON, &value)
+			if err := json.Unmarshal(valueJSON, &value); err != nil {
+				malformed(MalformedJSON, column1, err.Error())
+				continue
+			}
 			if _, ok := mapProperties[split[1]]; !ok {
 				mapProperties[split[1]] = make(map[string]json.RawMessage, 0)
 			}
 			mapProperties[split[1]][split[2]] = value["value"]
 		case "propl":
+			if len(split) != 3 {
+				malformed(MalformedColumn, column1, "expected propl:<name>:<index>")
+				continue
+			}
+			idx, err := strconv.Atoi(split[2])
+			if err != nil || idx < 0 {
+				malformed(MalformedListIndex, column1, fmt.Sprintf("invalid index %s", split[2]))
+				continue
+			}
+			if !json.Valid(valueJSON) {
+				malformed(MalformedJSON, column1, "invalid JSON value")
+				continue
+			}
 			if _, ok := listProperties[split[1]]; !ok {
 				listProperties[split[1]] = make(map[int]json.RawMessage, 0)
 			}
-			if idx, err := strconv.Atoi(split[2]); err == nil {
-				listProperties[split[1]][idx] = valueJSON
+			if _, ok := listProperties[split[1]][idx]; ok {
+				malformed(MalformedListIndex, column1, fmt.Sprintf("duplicate index %d", idx))
+				continue
 			}
+			listProperties[split[1]][idx] = valueJSON
+		// valid columns that are not used in the graph,
+		// other prefixes are ignored as well
+		case "parent_type", "relaxbackref", "META":
 		}
 	}
 
 	for k, v := range mapProperties {
-		if valueJSON, err := json.Marshal(v); err != nil {
-			fmt.Println(fmt.Errorf("Failed to marshal %v", v))
-		} else {
-			if propValue, ok := generateVertexProperty(valueJSON); ok {
-				vertex.AddProperty(k, propValue)
-			}
+		valueJSON, err := json.Marshal(v)
+		if err != nil {
+			malformed(MalformedJSON, "propm:"+k, err.Error())
+			continue
+		}
+		if propValue, ok, _ := generateVertexProperty(valueJSON); ok {
+			vertex.AddProperty(k, propValue)
 		}
 	}
 
 	for k, vs := range listProperties {
+		indexes := make([]int, 0, len(vs))
+		for idx := range vs {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
 		propList := make([]json.RawMessage, len(vs))
-		for idx, v := range vs {
-			propList[idx] = v
+		for i, idx := range indexes {
+			propList[i] = vs[idx]
 		}
-		if valueJSON, err := json.Marshal(propList); err != nil {
-			fmt.Println(fmt.Errorf("Failed to marshal %v", propList))
-		} else {
-			if propValue, ok := generateVertexProperty(valueJSON); ok {
-				vertex.AddProperty(k, propValue)
-			}
+		if indexes[len(indexes)-1] != len(indexes)-1 {
+			malformed(MalformedListIndex, "propl:"+k, fmt.Sprintf("sparse indexes %v", indexes))
+		}
+		valueJSON, err := json.Marshal(propList)
+		if err != nil {
+			malformed(MalformedJSON, "propl:"+k, err.Error())
+			continue
+		}
+		if propValue, ok, _ := generateVertexProperty(valueJSON); ok {
+			vertex.AddProperty(k, propValue)
 		}
 	}
 
+	return completeContrailResource(vertex)
+}
+
+// completeContrailResource flags incomplete resources and
+// adds the created/updated/deleted timestamps
+func completeContrailResource(vertex g.Vertex) (g.Vertex, error) {
 	if len(vertex.Label) == 0 {
 		vertex.Label = "_incomplete"
 		vertex.AddSingleProperty("_incomplete", true)
@@ -230,6 +405,44 @@ func GetContrailResource(session gockle.Session, rUUID uuid.UUID) (g.Vertex, err
 	return g.TransformVertex(vertex)
 }
 
+// InferFromFQNameEntry fills the type and fq_name of an incomplete
+// resource from its obj_fq_name_table entry. The inferred values
+// are listed in the _inferred property.
+func InferFromFQNameEntry(vertex g.Vertex, entry FQNameEntry) g.Vertex {
+	if !vertex.HasProp("_incomplete") {
+		return vertex
+	}
+	if vertex.Label == "_incomplete" && entry.Type != "" {
+		vertex.Label = entry.Type
+		vertex.AddProperty("_inferred", "type")
+	}
+	if _, ok := vertex.Properties["fq_name"]; !ok && len(entry.FQName) > 0 {
+		vertex.AddSingleProperty("fq_name", entry.FQName)
+		vertex.AddProperty("_inferred", "fq_name")
+	}
+	return vertex
+}
+
+// ResourceReader reads contrail resources from the contrail DB
+type ResourceReader interface {
+	GetResource(rUUID uuid.UUID) (g.Vertex, error)
+}
+
+// CassandraReader reads contrail resources from cassandra
+type CassandraReader struct {
+	session gockle.Session
+}
+
+// NewCassandraReader returns a reader using the given cassandra session
+func NewCassandraReader(session gockle.Session) CassandraReader {
+	return CassandraReader{session: session}
+}
+
+// GetResource returns the resource from obj_uuid_table
+func (r CassandraReader) GetResource(rUUID uuid.UUID) (g.Vertex, error) {
+	return GetContrailResource(r.session, rUUID)
+}
+
 func parseJSON(valueJSON []byte) (*gabs.Container, error) {
 	dec := json.NewDecoder(bytes.NewReader(valueJSON))
 	dec.UseNumber()
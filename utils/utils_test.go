@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	g "github.com/eonpatapon/contrail-gremlin/gremlin"
+	"github.com/maraino/go-mock"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/willfaught/gockle"
@@ -27,6 +28,8 @@ func TestGetContrailResource(t *testing.T) {
 			{"column1": []byte("prop:object"), "value": `{"bool": false, "sub_object": {"foo": "bar"}}`},
 			{"column1": []byte("ref:bar:" + id2.String()), "value": `{"attr": {"foo": false}}`},
 			{"column1": []byte("children:foobar:" + id3.String()), "value": `{"attr": {"foo": false}}`},
+			{"column1": []byte("relaxbackref:" + id3.String()), "value": `null`},
+			{"column1": []byte("META:latest_col_ts"), "value": `null`},
 		},
 		nil,
 	)
@@ -96,3 +99,76 @@ func TestGetContrailResourceNoEdges(t *testing.T) {
 
 	assert.Equal(t, expectedVertex, vertex, "")
 }
+
+func TestGetContrailFQNameEntries(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	entries := [][]string{
+		{"virtual_network", "default-domain:admin:vn1:" + id1.String()},
+		{"virtual_network", "default-domain:admin:vn2:not-a-uuid"},
+	}
+	i := 0
+	it := &gockle.IteratorMock{}
+	it.When("Scan", mock.Any).Call(func(results []interface{}) bool {
+		if i >= len(entries) {
+			return false
+		}
+		*results[0].(*string) = entries[i][0]
+		*results[1].(*string) = entries[i][1]
+		i++
+		return true
+	})
+	it.When("Close").Return(nil)
+
+	session := &gockle.SessionMock{}
+	session.When("ScanIterator", "SELECT key, column1 FROM obj_fq_name_table", []interface{}(nil)).Return(it)
+
+	c := make(chan FQNameEntry, 10)
+	err := GetContrailFQNameEntries(session, c)
+	close(c)
+
+	assert.Nil(t, err)
+	assert.Equal(t, FQNameEntry{
+		Type:   "virtual_network",
+		FQName: []string{"default-domain", "admin", "vn1"},
+		UUID:   id1,
+	}, <-c)
+	_, ok := <-c
+	assert.False(t, ok)
+}
+
+func TestGetContrailResourceMalformed(t *testing.T) {
+	id1, _ := uuid.NewV4()
+	query := "SELECT key, column1, value FROM obj_uuid_table WHERE key=?"
+
+	session := &gockle.SessionMock{}
+	session.When("ScanMapSlice", query, []interface{}{id1.String()}).Return(
+		[]map[string]interface{}{
+			{"column1": []byte("type"), "value": `"foo"`},
+			{"column1": []byte("prop:broken"), "value": `{"foo": `},
+			{"column1": []byte("ref:bar:not-a-uuid"), "value": `{"attr": null}`},
+			{"column1": []byte("propl:list:0"), "value": `"a"`},
+			{"column1": []byte("propl:list:2"), "value": `"c"`},
+			{"column1": []byte("propl:list:02"), "value": `"d"`},
+			{"column1": []byte("propl:list:x"), "value": `"e"`},
+			{"column1": []byte("parent_type"), "value": `"bar"`},
+			{"column1": []byte("relaxbackref:" + id1.String()), "value": `null`},
+		},
+		nil,
+	)
+
+	vertex, err := GetContrailResource(session, id1)
+	assert.Nil(t, err)
+
+	kinds := make(map[string][]string)
+	for _, m := range Malformations(vertex) {
+		kinds[m.Kind] = append(kinds[m.Kind], m.Column)
+	}
+	assert.Equal(t, map[string][]string{
+		MalformedJSON:      {"prop:broken"},
+		MalformedUUID:      {"ref:bar:not-a-uuid"},
+		MalformedListIndex: {"propl:list:02", "propl:list:x", "propl:list"},
+	}, kinds)
+	assert.Equal(t, 0, len(vertex.OutE))
+	list, _ := vertex.PropertyValue("list")
+	assert.Equal(t, []interface{}{"a", "c"}, list.([]g.Property)[0].Value)
+}